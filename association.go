@@ -0,0 +1,258 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Origins of association statements (values of labelOrigin), named after the
+// GORM callbacks executing them.
+const (
+	originPreload                = "preload"
+	originSaveBeforeAssociations = "save_before_associations"
+	originSaveAfterAssociations  = "save_after_associations"
+)
+
+// statementOriginKey is the context key of the statementOrigin of the
+// statements executed by a GORM callback, scoped to the plugin scope.
+type statementOriginKey struct {
+	scope string
+}
+
+// statementOrigin is added to the context of a statement while GORM preloads
+// or saves its associations, so the statements executed for them (which
+// inherit the context) can be told apart.
+type statementOrigin struct {
+	origin string
+
+	// statement is the statement whose associations are loaded or saved.
+	statement *gorm.Statement
+	// parent is the context of statement before the origin was added.
+	parent context.Context
+}
+
+// markOrigin returns a callback adding a statementOrigin with origin to the
+// context of the statement, if it has associations.
+func (h *callbackHandler) markOrigin(origin string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		stmt := db.Statement
+		if stmt.Context == nil || stmt.Schema == nil || len(stmt.Schema.Relationships.Relations) == 0 {
+			return
+		}
+		if origin == originPreload && len(stmt.Preloads) == 0 {
+			return
+		}
+
+		stmt.Context = context.WithValue(stmt.Context, h.originKey, &statementOrigin{
+			origin:    origin,
+			statement: stmt,
+			parent:    stmt.Context,
+		})
+	}
+}
+
+// restoreOrigin removes the statementOrigin added by markOrigin from the
+// context of the statement, so it doesn't leak to later statements reusing it.
+func (h *callbackHandler) restoreOrigin(db *gorm.DB) {
+	if o, ok := h.originOf(db); ok && o.statement == db.Statement {
+		db.Statement.Context = o.parent
+	}
+}
+
+// originOf returns the statementOrigin in the context of the statement in db.
+func (h *callbackHandler) originOf(db *gorm.DB) (*statementOrigin, bool) {
+	if db.Statement.Context == nil {
+		return nil, false
+	}
+
+	o, ok := db.Statement.Context.Value(h.originKey).(*statementOrigin)
+	return o, ok
+}
+
+// observeAssociation counts the statement in db and observes its duration if
+// it was executed for an association of another statement.
+func (h *callbackHandler) observeAssociation(db *gorm.DB, elapsed time.Duration, timed bool) {
+	o, ok := h.originOf(db)
+	if !ok || o.statement == db.Statement {
+		return
+	}
+
+	status := metricStatusSuccess
+	if db.Error != nil {
+		status = metricStatusFail
+	}
+
+	labels := h.limiter.limit(metricAssociationStatementsTotal, mergeLabels(prometheus.Labels{
+		labelOrigin:      o.origin,
+		labelAssociation: o.association(db.Statement),
+		labelStatus:      status,
+	}, h.defaultLabels))
+
+	h.counters.associationStatements.With(labels).Inc()
+	h.statsd.count(metricAssociationStatementsTotal, 1, labels)
+
+	if timed {
+		h.counters.associationStatementsDuration.With(labels).Observe(milliseconds(elapsed))
+		h.statsd.timing(metricAssociationStatementsDuration, milliseconds(elapsed), labels)
+	}
+}
+
+// association returns the name of the association of o.statement that stmt
+// was executed for. The candidates are the associations handled by the origin
+// of which the model or join table matches the table of stmt. If several remain
+// (e.g. self-referential associations), the ones whose keys stmt filters on
+// (preloads) or assigns (saved has one and has many associations) are picked.
+// Associations that still can't be told apart are joined by a comma.
+func (o *statementOrigin) association(stmt *gorm.Statement) string {
+	parent := o.statement
+	table := stmt.Table
+
+	var candidates []*schema.Relationship
+	for name, rel := range parent.Schema.Relationships.Relations {
+		if !o.handles(name, rel) {
+			continue
+		}
+
+		if (rel.FieldSchema != nil && rel.FieldSchema.Table == table) ||
+			(rel.JoinTable != nil && rel.JoinTable.Table == table) {
+			candidates = append(candidates, rel)
+		}
+	}
+
+	if len(candidates) > 1 {
+		columns := keyColumns(stmt)
+
+		var matching []*schema.Relationship
+		for _, rel := range candidates {
+			for _, key := range relationKeys(rel, table) {
+				if columns[key] {
+					matching = append(matching, rel)
+					break
+				}
+			}
+		}
+
+		if len(matching) > 0 {
+			candidates = matching
+		}
+	}
+
+	names := make([]string, len(candidates))
+	for i, rel := range candidates {
+		names[i] = rel.Name
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// handles returns true if the association name can execute statements for the
+// origin: preloads only load preloaded associations, belongs to associations
+// are saved before the statement and the others after it.
+func (o *statementOrigin) handles(name string, rel *schema.Relationship) bool {
+	switch o.origin {
+	case originPreload:
+		return preloaded(o.statement, name)
+	case originSaveBeforeAssociations:
+		return rel.Type == schema.BelongsTo
+	default:
+		return rel.Type != schema.BelongsTo
+	}
+}
+
+// relationKeys returns the columns of table that GORM uses to preload or save
+// rel for its parent: the foreign keys referencing the parent for join tables
+// and has one and has many associations, or the primary keys of the associated
+// model otherwise.
+func relationKeys(rel *schema.Relationship, table string) []string {
+	joinTable := rel.JoinTable != nil && rel.JoinTable.Table == table
+
+	var keys []string
+	for _, ref := range rel.References {
+		switch {
+		case ref.PrimaryValue != "":
+			continue
+		case ref.OwnPrimaryKey && (joinTable || rel.JoinTable == nil):
+			keys = append(keys, ref.ForeignKey.DBName)
+		case !ref.OwnPrimaryKey && !joinTable:
+			keys = append(keys, ref.PrimaryKey.DBName)
+		}
+	}
+
+	return keys
+}
+
+// keyColumns returns the columns stmt filters on using IN or equality
+// conditions, and the columns assigned on conflict when GORM saves has one and
+// has many associations.
+func keyColumns(stmt *gorm.Statement) map[string]bool {
+	columns := make(map[string]bool)
+
+	addColumn := func(column interface{}) {
+		switch c := column.(type) {
+		case clause.Column:
+			columns[c.Name] = true
+		case []clause.Column:
+			for _, col := range c {
+				columns[col.Name] = true
+			}
+		case string:
+			columns[c] = true
+		}
+	}
+
+	if where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where); ok {
+		for _, expr := range where.Exprs {
+			switch e := expr.(type) {
+			case clause.IN:
+				addColumn(e.Column)
+			case clause.Eq:
+				addColumn(e.Column)
+			}
+		}
+	}
+
+	if onConflict, ok := stmt.Clauses["ON CONFLICT"].Expression.(clause.OnConflict); ok {
+		for _, assignment := range onConflict.DoUpdates {
+			columns[assignment.Column.Name] = true
+		}
+	}
+
+	return columns
+}
+
+// preloaded returns true if the association name of stmt is preloaded.
+func preloaded(stmt *gorm.Statement, name string) bool {
+	if _, all := stmt.Preloads[clause.Associations]; all {
+		return true
+	}
+
+	for preload := range stmt.Preloads {
+		if strings.SplitN(preload, ".", 2)[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
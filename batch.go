@@ -0,0 +1,76 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// batchSizeBuckets are the buckets of the batch size histogram, in rows.
+var batchSizeBuckets = prometheus.ExponentialBuckets(1, 4, 8)
+
+// batchObservers contains the batch metrics of a kind of INSERT statement.
+type batchObservers struct {
+	total prometheus.Counter
+	size  prometheus.Observer
+}
+
+// newBatchObservers resolves the series of the batch metrics in counters with
+// labels for kind. The series are initialized at 0.
+func newBatchObservers(counters *queryCounters, labels prometheus.Labels, kind string) batchObservers {
+	l := mergeLabels(prometheus.Labels{labelKind: kind}, labels)
+
+	return batchObservers{
+		total: counters.batches.With(l),
+		size:  counters.batchSize.With(l),
+	}
+}
+
+// observeBatch observes the amount of rows inserted by the INSERT statement in
+// db, if it succeeded. Statements inserting a slice or array of records are
+// counted as batches, regardless of the amount of rows: the last batch of
+// CreateInBatches may contain a single row, and GORM doesn't mark the
+// statements it creates in any other way.
+func (h *callbackHandler) observeBatch(db *gorm.DB) {
+	if !checkRegistration(db) || db.Error != nil {
+		return
+	}
+
+	c, ok := db.Statement.Clauses["VALUES"]
+	if !ok {
+		return
+	}
+
+	values, ok := c.Expression.(clause.Values)
+	if !ok || len(values.Values) == 0 {
+		return
+	}
+
+	observers := h.activeObservers(db)
+	batch := observers.plainBatches
+	if kindOf(db, OperationCreate) == kindUpsert {
+		batch = observers.upsertBatches
+	}
+
+	batch.size.Observe(float64(len(values.Values)))
+
+	if kind := db.Statement.ReflectValue.Kind(); kind == reflect.Slice || kind == reflect.Array {
+		batch.total.Inc()
+	}
+}
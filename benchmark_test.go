@@ -0,0 +1,116 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// BenchmarkCallbacks measures the overhead of gormetrics on statements. Dry run
+// sessions build statements without executing them, so the difference between
+// the plain and instrumented runs is the overhead of the callbacks.
+func BenchmarkCallbacks(b *testing.B) {
+	for _, instrumented := range []bool{false, true} {
+		name := "plain"
+		if instrumented {
+			name = "instrumented"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			db := newBenchmarkDB(b, instrumented)
+
+			b.Run("create", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					db.Create(&testUser{Name: "alice"})
+				}
+			})
+
+			b.Run("query", func(b *testing.B) {
+				var users []testUser
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					db.Where("name = ?", "alice").Find(&users)
+				}
+			})
+
+			b.Run("update", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					db.Model(&testUser{ID: 1}).Update("name", "bob")
+				}
+			})
+
+			b.Run("delete", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					db.Delete(&testUser{ID: 1})
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkObserveStatement measures the callbacks observing a single statement,
+// without GORM building the statement.
+func BenchmarkObserveStatement(b *testing.B) {
+	db := newBenchmarkDB(b, false)
+	h, err := newCallbackHandler(extraInfo{dbName: "test", driverName: "sqlite3"}, getOpts([]RegisterOpt{
+		WithRegisterer(prometheus.NewRegistry()),
+	}), nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stmt := db.Model(&testUser{}).Statement
+	tx := &gorm.DB{Config: db.Config, Statement: stmt}
+	ctx := stmt.Context
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// The connection request is marked in the context of the statement.
+		stmt.Context = ctx
+
+		h.setStartTime(tx)
+		h.beforeQueryExecution(tx)
+		h.afterQueryExecution(tx)
+		h.afterQuery(tx)
+	}
+}
+
+// newBenchmarkDB opens a dry run session on a SQLite database, instrumented by
+// gormetrics if instrumented is true.
+func newBenchmarkDB(b *testing.B, instrumented bool) *gorm.DB {
+	b.Helper()
+
+	db := newTestDB(b)
+
+	if instrumented {
+		if err := Register(db, "test", WithRegisterer(prometheus.NewRegistry()), WithLogger(benchmarkLogger{})); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return db.Session(&gorm.Session{DryRun: true})
+}
+
+type benchmarkLogger struct{}
+
+func (benchmarkLogger) Printf(string, ...interface{}) {}
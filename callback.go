@@ -16,6 +16,9 @@ package gormetrics
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/gorm"
@@ -23,6 +26,8 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	gmdriver "github.com/survivorbat/gormetrics/driver"
 )
 
 // callbackHandler manages gorm query callback handling so query
@@ -31,26 +36,107 @@ type callbackHandler struct {
 	opts          *pluginOpts
 	counters      *queryCounters
 	defaultLabels map[string]string
+
+	// observers contains the *observerCache, created when registering and
+	// again when the database becomes active after it expired.
+	observers atomic.Value
+
+	// expiry is nil if the idle TTL is disabled.
+	expiry *idleExpiry
+
+	// timingsKey is the setting key under which statementTimings are stored.
+	// It's converted to an interface once, so looking it up doesn't allocate.
+	timingsKey interface{}
+	// originKey is the context key of the statementOrigin, see timingsKey.
+	originKey interface{}
+
+	// limiter is nil if the cardinality limits are disabled.
+	limiter *cardinalityLimiter
+
+	// nPlusOne is nil if the N+1 query detector is disabled.
+	nPlusOne *nPlusOneDetector
+
+	// statementLog is nil if the statement log is disabled.
+	statementLog *statementLog
+
+	// statsd is nil if the StatsD backend is disabled.
+	statsd *statsdClient
+
+	sync.Mutex
 }
 
 func (h *callbackHandler) registerCallback(db *gorm.DB) {
 	cb := db.Callback()
 
-	cb.Create().Before("gorm:create").Register(
+	// Every chain is timed twice: once around the complete GORM pipeline
+	// (hooks, associations and the statement itself) and once around the
+	// core callback that hands the statement to the driver. Note that GORM
+	// places callbacks registered with After at the end of the chain, so
+	// the end of the execution is marked with Before on the next callback.
+	// Default transactions take a connection from the pool when they begin,
+	// so the connection request is marked before that (if they're enabled).
+	if cb.Create().Get("gorm:begin_transaction") != nil {
+		cb.Create().Before("gorm:begin_transaction").Register(
+			h.opts.callbackName("before_create_transaction"),
+			h.markConnectionRequest,
+		)
+	}
+
+	if cb.Delete().Get("gorm:begin_transaction") != nil {
+		cb.Delete().Before("gorm:begin_transaction").Register(
+			h.opts.callbackName("before_delete_transaction"),
+			h.markConnectionRequest,
+		)
+	}
+
+	if cb.Update().Get("gorm:begin_transaction") != nil {
+		cb.Update().Before("gorm:begin_transaction").Register(
+			h.opts.callbackName("before_update_transaction"),
+			h.markConnectionRequest,
+		)
+	}
+
+	// Soft deletes are built using the clauses of the update processor instead
+	// of the BuildClauses of the statement, so the comment is added to those.
+	if h.opts.sqlCommenter != nil {
+		cb.Update().Clauses = withClause(cb.Update().Clauses, h.opts.settingKey(sqlCommentClauseKey))
+	}
+
+	cb.Create().Before("gorm:before_create").Register(
 		h.opts.callbackName("before_create"),
 		h.setStartTime,
 	)
 
+	cb.Create().Before("gorm:create").Register(
+		h.opts.callbackName("before_create_execution"),
+		h.beforeCreateExecution,
+	)
+
+	cb.Create().Before("gorm:save_after_associations").Register(
+		h.opts.callbackName("after_create_execution"),
+		h.afterCreateExecution,
+	)
+
 	cb.Create().After("gorm:after_create").Register(
 		h.opts.callbackName("after_create"),
 		h.afterCreate,
 	)
 
-	cb.Delete().Before("gorm:delete").Register(
+	cb.Delete().Before("gorm:before_delete").Register(
 		h.opts.callbackName("before_delete"),
 		h.setStartTime,
 	)
 
+	cb.Delete().Before("gorm:delete").Register(
+		h.opts.callbackName("before_delete_execution"),
+		h.beforeDeleteExecution,
+	)
+
+	cb.Delete().Before("gorm:after_delete").Register(
+		h.opts.callbackName("after_delete_execution"),
+		h.afterDeleteExecution,
+	)
+
 	cb.Delete().After("gorm:after_delete").Register(
 		h.opts.callbackName("after_delete"),
 		h.afterDelete,
@@ -61,24 +147,294 @@ func (h *callbackHandler) registerCallback(db *gorm.DB) {
 		h.setStartTime,
 	)
 
+	cb.Query().Before("gorm:query").Register(
+		h.opts.callbackName("before_query_execution"),
+		h.beforeQueryExecution,
+	)
+
+	cb.Query().Before("gorm:preload").Register(
+		h.opts.callbackName("after_query_execution"),
+		h.afterQueryExecution,
+	)
+
 	cb.Query().After("gorm:after_query").Register(
 		h.opts.callbackName("after_query"),
 		h.afterQuery,
 	)
 
-	cb.Update().Before("gorm:update").Register(
+	cb.Update().Before("gorm:before_update").Register(
 		h.opts.callbackName("before_update"),
 		h.setStartTime,
 	)
 
+	cb.Update().Before("gorm:update").Register(
+		h.opts.callbackName("before_update_execution"),
+		h.beforeUpdateExecution,
+	)
+
+	cb.Update().Before("gorm:save_after_associations").Register(
+		h.opts.callbackName("after_update_execution"),
+		h.afterUpdateExecution,
+	)
+
 	cb.Update().After("gorm:after_update").Register(
 		h.opts.callbackName("after_update"),
 		h.afterUpdate,
 	)
+
+	// Statements executed to preload or save associations inherit the context
+	// of the statement, which carries their origin while GORM executes them.
+	cb.Query().Before("gorm:preload").Register(
+		h.opts.callbackName("before_query_preload"),
+		h.markOrigin(originPreload),
+	)
+
+	cb.Query().Before("gorm:after_query").Register(
+		h.opts.callbackName("after_query_preload"),
+		h.restoreOrigin,
+	)
+
+	cb.Create().Before("gorm:save_before_associations").Register(
+		h.opts.callbackName("before_create_save_before_associations"),
+		h.markOrigin(originSaveBeforeAssociations),
+	)
+
+	cb.Create().Before("gorm:create").Register(
+		h.opts.callbackName("after_create_save_before_associations"),
+		h.restoreOrigin,
+	)
+
+	cb.Create().Before("gorm:save_after_associations").Register(
+		h.opts.callbackName("before_create_save_after_associations"),
+		h.markOrigin(originSaveAfterAssociations),
+	)
+
+	cb.Create().Before("gorm:after_create").Register(
+		h.opts.callbackName("after_create_save_after_associations"),
+		h.restoreOrigin,
+	)
+
+	cb.Update().Before("gorm:save_before_associations").Register(
+		h.opts.callbackName("before_update_save_before_associations"),
+		h.markOrigin(originSaveBeforeAssociations),
+	)
+
+	cb.Update().Before("gorm:update").Register(
+		h.opts.callbackName("after_update_save_before_associations"),
+		h.restoreOrigin,
+	)
+
+	cb.Update().Before("gorm:save_after_associations").Register(
+		h.opts.callbackName("before_update_save_after_associations"),
+		h.markOrigin(originSaveAfterAssociations),
+	)
+
+	cb.Update().Before("gorm:after_update").Register(
+		h.opts.callbackName("after_update_save_after_associations"),
+		h.restoreOrigin,
+	)
+}
+
+// callbackRemover is implemented by the callback processors of GORM.
+type callbackRemover interface {
+	Get(name string) func(*gorm.DB)
+	Remove(name string) error
+}
+
+// callbackNames contains the names of the callbacks registered by
+// registerCallback, formatted with the operation.
+var callbackNames = []string{
+	"before_%v_transaction",
+	"before_%v",
+	"before_%v_execution",
+	"after_%v_execution",
+	"after_%v",
+	"before_%v_preload",
+	"after_%v_preload",
+	"before_%v_save_before_associations",
+	"after_%v_save_before_associations",
+	"before_%v_save_after_associations",
+	"after_%v_save_after_associations",
+}
+
+// removeCallbacks removes the callbacks registered by registerCallback.
+func (h *callbackHandler) removeCallbacks(db *gorm.DB) error {
+	cb := db.Callback()
+
+	processors := map[string]callbackRemover{
+		"create": cb.Create(),
+		"delete": cb.Delete(),
+		"query":  cb.Query(),
+		"update": cb.Update(),
+	}
+
+	for operation, processor := range processors {
+		for _, callback := range callbackNames {
+			name := h.opts.callbackName(fmt.Sprintf(callback, operation))
+			if processor.Get(name) == nil {
+				continue
+			}
+
+			if err := processor.Remove(name); err != nil {
+				return errors.Wrapf(err, "could not remove callback %v", name)
+			}
+		}
+	}
+
+	cb.Update().Clauses = withoutClause(cb.Update().Clauses, h.opts.settingKey(sqlCommentClauseKey))
+
+	return nil
+}
+
+const (
+	// Key (prefixed with the plugin scope) under which the start times of a
+	// statement are stored, see statementTimings.
+	timingsKey = "timings"
+)
+
+// statementTimings holds the start times of the measurements that are in
+// progress for a single statement.
+type statementTimings struct {
+	// statement is the statement the timings belong to. Nested statements
+	// (e.g. associations saved during a Create) copy the settings of their
+	// parent, but get their own timings.
+	statement *gorm.Statement
+
+	start     timingStack
+	execution timingStack
+}
+
+// timingStack holds the start times of a measurement. A stack is used so a
+// statement which re-enters a callback chain never overwrites the start time
+// of the outer measurement. Two start times fit without allocating.
+type timingStack struct {
+	inline [2]time.Time
+	starts []time.Time
+}
+
+func (s *timingStack) push(t time.Time) {
+	if s.starts == nil {
+		s.starts = s.inline[:0]
+	}
+	s.starts = append(s.starts, t)
+}
+
+func (s *timingStack) pop() (time.Time, bool) {
+	if len(s.starts) == 0 {
+		return time.Time{}, false
+	}
+
+	t := s.starts[len(s.starts)-1]
+	s.starts = s.starts[:len(s.starts)-1]
+	return t, true
+}
+
+// timings returns the statementTimings of the statement in db. If the statement
+// has none yet, they are created if create is true and nil is returned otherwise.
+func (h *callbackHandler) timings(db *gorm.DB, create bool) *statementTimings {
+	if value, ok := db.Statement.Settings.Load(h.timingsKey); ok {
+		if t, ok := value.(*statementTimings); ok && t.statement == db.Statement {
+			return t
+		}
+	}
+
+	if !create {
+		return nil
+	}
+
+	t := &statementTimings{statement: db.Statement}
+	db.Statement.Settings.Store(h.timingsKey, t)
+	return t
+}
+
+// elapsed pops the most recent start time of the statement in db, of its
+// execution if execution is true, and returns the time elapsed since. False is
+// returned if no start time was recorded.
+func (h *callbackHandler) elapsed(db *gorm.DB, execution bool) (time.Duration, bool) {
+	t := h.timings(db, false)
+	if t == nil {
+		return 0, false
+	}
+
+	stack := &t.start
+	if execution {
+		stack = &t.execution
+	}
+
+	start, ok := stack.pop()
+	if !ok {
+		return 0, false
+	}
+
+	return time.Since(start), true
 }
 
+const (
+	// Name of the clause containing the comment added by the SQL commenter.
+	sqlCommentClauseKey = "sql_comment"
+)
+
 func (h *callbackHandler) setStartTime(db *gorm.DB) {
-	db.Set("timeStart", time.Now())
+	h.timings(db, true).start.push(time.Now())
+}
+
+// markConnectionRequest records in the statement context that a connection is
+// about to be requested from the pool, so drivers wrapped by the driver package
+// can observe the time spent waiting for it. Statements in a transaction already
+// hold a connection and are skipped, as are all statements if no driver was
+// wrapped (which saves allocating a context for every statement).
+func (h *callbackHandler) markConnectionRequest(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Context == nil || !gmdriver.Wrapped() {
+		return
+	}
+
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return
+	}
+
+	db.Statement.Context = gmdriver.WithConnectionRequest(db.Statement.Context, time.Now())
+}
+
+// setExecutionStartTime marks the moment the statement is handed to the core
+// GORM callback. Nothing is executed if an earlier callback (e.g. a hook) failed,
+// so no execution time is recorded in that case.
+func (h *callbackHandler) setExecutionStartTime(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	h.timings(db, true).execution.push(time.Now())
+}
+
+func (h *callbackHandler) beforeCreateExecution(db *gorm.DB) {
+	h.commentStatement(db, OperationCreate)
+	h.markConnectionRequest(db)
+	h.setExecutionStartTime(db)
+}
+
+func (h *callbackHandler) beforeDeleteExecution(db *gorm.DB) {
+	h.commentStatement(db, OperationDelete)
+	h.markConnectionRequest(db)
+	h.setExecutionStartTime(db)
+}
+
+func (h *callbackHandler) beforeQueryExecution(db *gorm.DB) {
+	h.commentStatement(db, OperationQuery)
+	h.markConnectionRequest(db)
+	h.setExecutionStartTime(db)
+}
+
+func (h *callbackHandler) beforeUpdateExecution(db *gorm.DB) {
+	h.commentStatement(db, OperationUpdate)
+	h.markConnectionRequest(db)
+	h.setExecutionStartTime(db)
+}
+
+// commentStatement adds a SQL comment to the statement in db, if enabled.
+func (h *callbackHandler) commentStatement(db *gorm.DB, operation Operation) {
+	if h.opts.sqlCommenter != nil && db.Error == nil {
+		h.opts.sqlCommenter.comment(db, operation, h.opts.settingKey(sqlCommentClauseKey), h.defaultLabels)
+	}
 }
 
 // checkRegistration will check if the metrics should be registered
@@ -102,94 +458,151 @@ func checkRegistration(db *gorm.DB) bool {
 }
 
 func (h *callbackHandler) afterCreate(db *gorm.DB) {
-	if checkRegistration(db) {
-		h.updateCounterVectors(db, h.counters.creates)
-		h.updateHistogramVectors(db, h.counters.createsDuration)
-	}
+	h.afterStatement(db, OperationCreate)
+}
+
+func (h *callbackHandler) afterCreateExecution(db *gorm.DB) {
+	h.afterExecution(db, OperationCreate)
+	h.observeBatch(db)
 }
 
 func (h *callbackHandler) afterDelete(db *gorm.DB) {
-	if checkRegistration(db) {
-		h.updateCounterVectors(db, h.counters.deletes)
-		h.updateHistogramVectors(db, h.counters.deletesDuration)
-	}
+	h.afterStatement(db, OperationDelete)
+}
+
+func (h *callbackHandler) afterDeleteExecution(db *gorm.DB) {
+	h.afterExecution(db, OperationDelete)
 }
 
 func (h *callbackHandler) afterQuery(db *gorm.DB) {
-	if checkRegistration(db) {
-		h.updateCounterVectors(db, h.counters.queries)
-		h.updateHistogramVectors(db, h.counters.queriesDuration)
-	}
+	h.afterStatement(db, OperationQuery)
+}
+
+func (h *callbackHandler) afterQueryExecution(db *gorm.DB) {
+	h.afterExecution(db, OperationQuery)
 }
 
 func (h *callbackHandler) afterUpdate(db *gorm.DB) {
-	if checkRegistration(db) {
-		h.updateCounterVectors(db, h.counters.updates)
-		h.updateHistogramVectors(db, h.counters.updatesDuration)
+	h.afterStatement(db, OperationUpdate)
+}
+
+func (h *callbackHandler) afterUpdateExecution(db *gorm.DB) {
+	h.afterExecution(db, OperationUpdate)
+}
+
+// afterStatement observes the statement in db once the callback chain of
+// operation completed: the statement is counted and the time spent in the
+// complete chain is observed. If an error was added to db (db.Error), the
+// status "fail" is assigned, otherwise the status "success". Every statement
+// is also counted in gormetrics_all_total and gormetrics_all_duration.
+func (h *callbackHandler) afterStatement(db *gorm.DB, operation Operation) {
+	if !checkRegistration(db) {
+		return
 	}
+
+	observers := h.activeObservers(db)
+	o, all := observers.operation(operation, kindOf(db, operation)).of(db), observers.all.of(db)
+	o.total.Inc()
+	all.total.Inc()
+
+	elapsed, timed := h.elapsed(db, false)
+	if timed {
+		o.duration.Observe(milliseconds(elapsed))
+		all.duration.Observe(milliseconds(elapsed))
+	}
+
+	h.observeAssociation(db, elapsed, timed)
+	h.detectNPlusOne(db)
+	h.updateQueryStats(db, operation)
+	if timed {
+		h.recordStatement(db, operation, elapsed)
+	}
+	h.sendStatsD(operation, o, all, elapsed, timed)
 }
 
-// updateCounterVectors registers one or more of prometheus.CounterVec to increment
-// with the status in db (any type of query). If any errors are in
-// db.DB().GetErrors(), a status "fail" will be assigned to the increment.
-// Otherwise, a status "success" will be assigned.
-// Increments h.counters.all (gormetrics_all_total) by default.
-func (h *callbackHandler) updateCounterVectors(db *gorm.DB, vectors ...*prometheus.CounterVec) {
-	vectors = append(vectors, h.counters.all)
+// afterExecution works like afterStatement, but observes the time spent in the
+// core GORM callback (the driver executing the statement) instead of the
+// complete chain. The execution time is also accounted with the QueryStats
+// attached to the statement context, if any.
+func (h *callbackHandler) afterExecution(db *gorm.DB, operation Operation) {
+	if !checkRegistration(db) {
+		return
+	}
 
-	_, err := db.DB()
-	status := metricStatusFail
-	if err == nil {
-		status = metricStatusSuccess
+	elapsed, ok := h.elapsed(db, true)
+	if !ok {
+		return
 	}
 
-	labels := mergeLabels(prometheus.Labels{
-		labelStatus: status,
-	}, h.defaultLabels)
+	observers := h.activeObservers(db)
+	o, all := observers.operation(operation, kindOf(db, operation)).of(db), observers.all.of(db)
+	o.executionDuration.Observe(milliseconds(elapsed))
+	all.executionDuration.Observe(milliseconds(elapsed))
 
-	for _, counter := range vectors {
-		if counter == nil {
-			continue
-		}
+	if stats, ok := queryStatsOf(db); ok {
+		stats.addDuration(db.Statement.Context, elapsed)
+	}
+
+	h.sendExecutionStatsD(operation, o, all, elapsed)
+}
 
-		counter.With(labels).Add(1)
+// detectNPlusOne passes the statement in db to the N+1 query detector, if enabled.
+func (h *callbackHandler) detectNPlusOne(db *gorm.DB) {
+	if h.nPlusOne != nil {
+		h.nPlusOne.check(db, h.defaultLabels)
 	}
 }
 
-// updateHistogramVectors registers one or more of prometheus.HistogramVec to add observations to
-// with the status in db (any type of query). If any errors are in
-// db.DB().GetErrors(), a status "fail" will be assigned to the increment.
-// Otherwise, a status "success" will be assigned.
-// Increments h.counters.allDuration (gormetrics_all_total) by default.
-func (h *callbackHandler) updateHistogramVectors(db *gorm.DB, vectors ...*prometheus.HistogramVec) {
-	vectors = append(vectors, h.counters.allDuration)
+// recordStatement adds the statement in db to the statement log, if enabled.
+func (h *callbackHandler) recordStatement(db *gorm.DB, operation Operation, elapsed time.Duration) {
+	if h.statementLog != nil {
+		h.statementLog.record(db, operation, h.defaultLabels[labelDatabase], elapsed)
+	}
+}
 
-	_, err := db.DB()
-	status := metricStatusFail
-	if err == nil {
-		status = metricStatusSuccess
+// sendStatsD sends the statement observed by o and all to StatsD, if enabled.
+// Its duration is only sent if timed is true.
+func (h *callbackHandler) sendStatsD(operation Operation, o, all *statementObservers, elapsed time.Duration, timed bool) {
+	if h.statsd == nil {
+		return
 	}
 
-	labels := mergeLabels(prometheus.Labels{
-		labelStatus: status,
-	}, h.defaultLabels)
+	names := operationMetrics[operation]
 
-	for _, histogram := range vectors {
-		if histogram == nil {
-			continue
-		}
+	h.statsd.count(names.total, 1, o.labels)
+	h.statsd.count(metricAllTotal, 1, all.labels)
 
-		startTime, ok := db.Get("timeStart")
+	if timed {
+		h.statsd.timing(names.duration, milliseconds(elapsed), o.labels)
+		h.statsd.timing(metricAllDuration, milliseconds(elapsed), all.labels)
+	}
+}
 
-		if !ok {
-			continue
-		}
+// sendExecutionStatsD sends the execution duration of the statement observed by
+// o and all to StatsD, if enabled.
+func (h *callbackHandler) sendExecutionStatsD(operation Operation, o, all *statementObservers, elapsed time.Duration) {
+	if h.statsd == nil {
+		return
+	}
 
-		elapsed := time.Since(startTime.(time.Time)).Milliseconds()
-		histogram.With(labels).Observe(float64(elapsed))
+	h.statsd.timing(operationMetrics[operation].executionDuration, milliseconds(elapsed), o.labels)
+	h.statsd.timing(metricAllExecutionDuration, milliseconds(elapsed), all.labels)
+}
+
+// updateQueryStats accounts the statement in db with the QueryStats attached
+// to its context, if any.
+func (h *callbackHandler) updateQueryStats(db *gorm.DB, operation Operation) {
+	if stats, ok := queryStatsOf(db); ok {
+		stats.addStatement(db.Statement.Context, operation, db.RowsAffected, db.Error != nil)
 	}
 }
 
+// milliseconds converts d to (fractional) milliseconds, the unit of all
+// duration histograms.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 // extraInfo contains information for filtering the provided metrics.
 type extraInfo struct {
 	// The name of the database in use.
@@ -197,6 +610,24 @@ type extraInfo struct {
 
 	// The name of the driver powering database/sql (underlying database for GORM).
 	driverName string
+
+	// The instance of the database, empty if the instance label is disabled.
+	instance string
+}
+
+// labels returns the labels identifying the database: database, driver and
+// instance (if enabled).
+func (i extraInfo) labels() prometheus.Labels {
+	labels := prometheus.Labels{
+		labelDatabase: i.dbName,
+		labelDriver:   i.driverName,
+	}
+
+	if i.instance != "" {
+		labels[labelInstance] = i.instance
+	}
+
+	return labels
 }
 
 // newCallbackHandler creates a new callback handler configured with info and opts.
@@ -204,20 +635,245 @@ type extraInfo struct {
 // function, but sets label values which can be useful in the usage of
 // the provided metrics (driver, database, connection).
 // Automatically registers metrics.
-func newCallbackHandler(info extraInfo, opts *pluginOpts) (*callbackHandler, error) {
-	counters, err := newQueryCounters(opts.prometheusNamespace)
+func newCallbackHandler(info extraInfo, opts *pluginOpts, statsd *statsdClient, expiry *idleExpiry) (*callbackHandler, error) {
+	counters, err := newQueryCounters(opts.prometheusRegisterer, opts.prometheusNamespace, info.instance != "", opts.modelLabel)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create query gauges")
 	}
 
-	return &callbackHandler{
-		opts:     opts,
-		counters: counters,
-		defaultLabels: prometheus.Labels{
-			labelDriver:   info.driverName,
-			labelDatabase: info.dbName,
-		},
-	}, nil
+	defaultLabels := info.labels()
+
+	handler := &callbackHandler{
+		opts:          opts,
+		counters:      counters,
+		statementLog:  newStatementLog(opts),
+		statsd:        statsd,
+		expiry:        expiry,
+		limiter:       newCardinalityLimiter(opts, counters.droppedLabelValues, defaultLabels),
+		defaultLabels: defaultLabels,
+
+		timingsKey: opts.settingKey(timingsKey),
+		originKey:  statementOriginKey{scope: opts.gormPluginScope},
+	}
+	handler.observers.Store(handler.newObserverCache())
+
+	if opts.nPlusOneThreshold > 0 {
+		handler.nPlusOne = &nPlusOneDetector{
+			threshold: opts.nPlusOneThreshold,
+			report:    opts.nPlusOneReporter,
+			detected:  counters.nPlusOneDetected,
+			limiter:   handler.limiter,
+			statsd:    statsd,
+		}
+	}
+
+	return handler, nil
+}
+
+// handlerObservers contains the operationObservers of every operation, and of
+// every kind of the operations with a kind label (see operationKinds).
+type handlerObservers struct {
+	all     *operationObservers
+	creates kindObservers
+	deletes kindObservers
+	queries *operationObservers
+	updates kindObservers
+
+	plainBatches  batchObservers
+	upsertBatches batchObservers
+}
+
+// newHandlerObservers resolves the series of every operation in counters with
+// labels. The series are initialized at 0.
+func newHandlerObservers(counters *queryCounters, labels prometheus.Labels) *handlerObservers {
+	return &handlerObservers{
+		all: newOperationObservers(counters.all, counters.allDuration, counters.allExecutionDuration, labels),
+		creates: newKindObservers(
+			counters.creates, counters.createsDuration, counters.createsExecutionDuration, labels, operationKinds[OperationCreate],
+		),
+		deletes: newKindObservers(
+			counters.deletes, counters.deletesDuration, counters.deletesExecutionDuration, labels, operationKinds[OperationDelete],
+		),
+		queries: newOperationObservers(counters.queries, counters.queriesDuration, counters.queriesExecutionDuration, labels),
+		updates: newKindObservers(
+			counters.updates, counters.updatesDuration, counters.updatesExecutionDuration, labels, operationKinds[OperationUpdate],
+		),
+
+		plainBatches:  newBatchObservers(counters, labels, kindPlain),
+		upsertBatches: newBatchObservers(counters, labels, kindUpsert),
+	}
+}
+
+// operation returns the observers of kind of operation, see kindOf.
+func (o *handlerObservers) operation(operation Operation, kind string) *operationObservers {
+	switch operation {
+	case OperationCreate:
+		return o.creates[kind]
+	case OperationDelete:
+		return o.deletes[kind]
+	case OperationUpdate:
+		return o.updates[kind]
+	default:
+		return o.queries
+	}
+}
+
+// observerCache contains the resolved observers of a database.
+type observerCache struct {
+	// observers is nil if the model label is enabled.
+	observers *handlerObservers
+
+	// models contains the observers by model, if the model label is enabled.
+	models     map[string]*handlerObservers
+	modelsLock sync.RWMutex
+}
+
+// newObserverCache creates an observerCache. Without the model label the
+// series are resolved immediately, otherwise on the first statement of a model.
+func (h *callbackHandler) newObserverCache() *observerCache {
+	if h.opts.modelLabel {
+		return &observerCache{models: make(map[string]*handlerObservers)}
+	}
+
+	return &observerCache{observers: newHandlerObservers(h.counters, h.defaultLabels)}
+}
+
+// activeObservers marks the database as active (see WithIdleTTL) and returns
+// the observers of the statement in db. The series are resolved again if the
+// database expired.
+func (h *callbackHandler) activeObservers(db *gorm.DB) *handlerObservers {
+	if h.expiry.touch() {
+		h.revive()
+	}
+
+	cache := h.observers.Load().(*observerCache)
+	if cache.observers != nil {
+		return cache.observers
+	}
+
+	return h.modelObservers(cache, modelName(db))
+}
+
+// modelObservers returns the observers of model, resolving them (within the
+// cardinality limits) if they don't exist yet. All query metrics share the
+// values of the model label, so they're limited as gormetrics_all_total.
+func (h *callbackHandler) modelObservers(cache *observerCache, model string) *handlerObservers {
+	cache.modelsLock.RLock()
+	observers, exists := cache.models[model]
+	cache.modelsLock.RUnlock()
+
+	if exists {
+		return observers
+	}
+
+	cache.modelsLock.Lock()
+	defer cache.modelsLock.Unlock()
+
+	if observers, exists := cache.models[model]; exists {
+		return observers
+	}
+
+	labels := mergeLabels(prometheus.Labels{labelModel: model}, h.defaultLabels)
+	observers = newHandlerObservers(h.counters, h.limiter.limit(metricAllTotal, labels))
+	cache.models[model] = observers
+
+	return observers
+}
+
+// modelName returns the name of the model of the statement in db: the name of
+// its schema, or the name of the Go type of the model if it wasn't parsed.
+// Statements without a model (e.g. raw SQL) return an empty name.
+func modelName(db *gorm.DB) string {
+	if db.Statement.Schema != nil {
+		return db.Statement.Schema.Name
+	}
+
+	if db.Statement.Model == nil {
+		return ""
+	}
+
+	t := reflect.TypeOf(db.Statement.Model)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
+
+// expire deletes the query series of the database, after it has been idle for
+// longer than the idle TTL.
+func (h *callbackHandler) expire() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.expiry.setExpired(true)
+	deleteSeries(h.defaultLabels, h.counters.collectors()...)
+	h.limiter.reset()
+}
+
+// revive resolves the series of the database again after it expired.
+func (h *callbackHandler) revive() {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.expiry.expired() {
+		return
+	}
+
+	h.observers.Store(h.newObserverCache())
+	h.expiry.setExpired(false)
+}
+
+// statementObservers contains the counter and histograms of an operation for
+// a single status. They are resolved when registering, so observing a statement
+// doesn't allocate labels or look up its series.
+type statementObservers struct {
+	total             prometheus.Counter
+	duration          prometheus.Observer
+	executionDuration prometheus.Observer
+
+	// labels are the labels of the series, which must not be modified.
+	labels prometheus.Labels
+}
+
+// operationObservers contains the statementObservers of an operation for
+// every status.
+type operationObservers struct {
+	success statementObservers
+	fail    statementObservers
+}
+
+// newOperationObservers resolves the series of the vectors of an operation
+// with labels for every status. The series are initialized at 0.
+func newOperationObservers(
+	total *prometheus.CounterVec,
+	duration *prometheus.HistogramVec,
+	executionDuration *prometheus.HistogramVec,
+	labels prometheus.Labels,
+) *operationObservers {
+	resolve := func(status string) statementObservers {
+		l := mergeLabels(prometheus.Labels{labelStatus: status}, labels)
+
+		return statementObservers{
+			total:             total.With(l),
+			duration:          duration.With(l),
+			executionDuration: executionDuration.With(l),
+			labels:            l,
+		}
+	}
+
+	return &operationObservers{
+		success: resolve(metricStatusSuccess),
+		fail:    resolve(metricStatusFail),
+	}
+}
+
+// of returns the observers for the status of the statement in db.
+func (o *operationObservers) of(db *gorm.DB) *statementObservers {
+	if db.Error != nil {
+		return &o.fail
+	}
+	return &o.success
 }
 
 // callbackName creates a GORM callback name based on the configured plugin
@@ -226,6 +882,13 @@ func (c *pluginOpts) callbackName(callback string) string {
 	return fmt.Sprintf("%v:%v", c.gormPluginScope, callback)
 }
 
+// settingKey creates a key for values gormetrics stores on a GORM statement,
+// scoped to the configured plugin scope so other plugins (or other gormetrics
+// instances) never read or overwrite them.
+func (c *pluginOpts) settingKey(key string) string {
+	return fmt.Sprintf("%v:%v", c.gormPluginScope, key)
+}
+
 // Merges maps a and b. a is returned with extra values from b. Existing items
 // in a with a matching key in b will not get overwritten.
 func mergeLabels(a, b prometheus.Labels) prometheus.Labels {
@@ -15,10 +15,18 @@
 package gormetrics
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/prometheus/client_golang/prometheus"
+	gmdriver "github.com/survivorbat/gormetrics/driver"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func TestMergeLabels(t *testing.T) {
@@ -44,3 +52,171 @@ func TestMergeLabels(t *testing.T) {
 		}
 	}
 }
+
+// hookDelay is the time spent in the BeforeCreate hook of testTimedChild.
+const hookDelay = 20 * time.Millisecond
+
+type testTimedParent struct {
+	ID       uint
+	Children []testTimedChild `gorm:"foreignKey:ParentID"`
+}
+
+type testTimedChild struct {
+	ID       uint
+	ParentID uint
+}
+
+func (testTimedChild) BeforeCreate(*gorm.DB) error {
+	time.Sleep(hookDelay)
+	return nil
+}
+
+func TestExecutionDuration(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&testTimedParent{}, &testTimedChild{}); err != nil {
+		t.Fatal(err)
+	}
+	r := registerTest(t, db, prometheus.NewRegistry())
+
+	db.Create(&testTimedParent{Children: []testTimedChild{{}}})
+
+	labels := prometheus.Labels{labelDatabase: "test"}
+	duration := durationSummary(labels, r.handler.counters.createsDuration)
+	execution := durationSummary(labels, r.handler.counters.createsExecutionDuration)
+
+	// The parent and the child both have their own timings.
+	if duration.Count != 2 || execution.Count != 2 {
+		t.Fatalf("got %d durations and %d execution durations, want 2 of each", duration.Count, execution.Count)
+	}
+
+	// The hook of the child is part of the duration of both statements, since
+	// the child is saved within the pipeline of the parent, but never of their
+	// execution.
+	if duration.Sum < 2*hookDelay {
+		t.Fatalf("got a total duration of %v, want at least %v", duration.Sum, 2*hookDelay)
+	}
+	if execution.Sum >= hookDelay {
+		t.Fatalf("got a total execution duration of %v, want it to exclude the hook of %v", execution.Sum, hookDelay)
+	}
+}
+
+func TestStatementTimings(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry())
+	h := r.handler
+
+	parent := db.Model(&testUser{})
+	h.setStartTime(parent)
+	h.setStartTime(parent)
+
+	// Nested statements copy the settings of their parent, including its timings.
+	child := db.Model(&testUser{})
+	parent.Statement.Settings.Range(func(k, v interface{}) bool {
+		child.Statement.Settings.Store(k, v)
+		return true
+	})
+
+	if _, ok := h.elapsed(child, false); ok {
+		t.Fatal("expected the child not to have a start time of its own")
+	}
+
+	h.setStartTime(child)
+	if h.timings(child, false) == h.timings(parent, false) {
+		t.Fatal("expected the child to get its own timings")
+	}
+	if _, ok := h.elapsed(child, false); !ok {
+		t.Fatal("expected the child to have a start time")
+	}
+
+	// Re-entering the callback chain pushed a second start time on the parent.
+	for i := 0; i < 2; i++ {
+		if _, ok := h.elapsed(parent, false); !ok {
+			t.Fatalf("expected the parent to have start time %d", i+1)
+		}
+	}
+	if _, ok := h.elapsed(parent, false); ok {
+		t.Fatal("expected the start times of the parent to be popped")
+	}
+	if _, ok := h.elapsed(parent, true); ok {
+		t.Fatal("expected the parent not to have an execution start time")
+	}
+}
+
+func TestConnectionRequest(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	plain, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	sqlDB := sql.OpenDB(gmdriver.WrapConnector(dsnConnector{dsn: "file::memory:", driver: plain.Driver()}, "test",
+		gmdriver.WithRegisterer(registry), gmdriver.WithDriverName("sqlite3")))
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(1)
+
+	db, err := gorm.Open(sqlite.Dialector{Conn: sqlDB}, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatal(err)
+	}
+	registerTest(t, db, registry)
+
+	// Hold the only connection, so the next statement waits for the pool.
+	held, err := sqlDB.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wait = 20 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		done <- db.Find(&[]testUser{}).Error
+	}()
+
+	time.Sleep(wait)
+	if err := held.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "gormetrics_connection_wait_duration" {
+			continue
+		}
+
+		histogram := family.GetMetric()[0].GetHistogram()
+		if histogram.GetSampleCount() != 1 {
+			t.Fatalf("got %d observed waits, want 1", histogram.GetSampleCount())
+		}
+		if min := float64(wait) / float64(time.Millisecond); histogram.GetSampleSum() < min {
+			t.Fatalf("got a wait of %vms, want at least %vms", histogram.GetSampleSum(), min)
+		}
+		return
+	}
+
+	t.Fatal("connection wait duration wasn't observed")
+}
+
+// dsnConnector opens connections to dsn using driver.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
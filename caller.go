@@ -0,0 +1,55 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// packagePath is the import path of gormetrics, used to skip its own frames.
+var packagePath = reflect.TypeOf(callbackHandler{}).PkgPath()
+
+// callerOf returns the location (directory/file.go:line) of the first frame on
+// the stack that is not part of GORM or gormetrics, which is the application
+// code that issued the statement. An empty string is returned if there is none.
+func callerOf() string {
+	var pcs [32]uintptr
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+
+		if !isLibraryFrame(frame.Function) {
+			dir := filepath.Base(filepath.Dir(frame.File))
+			return fmt.Sprintf("%s/%s:%d", dir, filepath.Base(frame.File), frame.Line)
+		}
+
+		if !more {
+			return ""
+		}
+	}
+}
+
+// isLibraryFrame returns true if function belongs to GORM or gormetrics.
+func isLibraryFrame(function string) bool {
+	return strings.HasPrefix(function, "gorm.io/") ||
+		strings.HasPrefix(function, packagePath+".") ||
+		strings.HasPrefix(function, packagePath+"/")
+}
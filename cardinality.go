@@ -0,0 +1,190 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overflowValue replaces label values exceeding a cardinality limit.
+const overflowValue = "__overflow__"
+
+// cardinalityLimiter caps the distinct values of every dynamic label (e.g.
+// table) per metric, and the distinct series per metric, of a single database.
+// Values exceeding a limit are folded into overflowValue and counted in
+// dropped_label_values_total. A nil cardinalityLimiter doesn't limit anything.
+type cardinalityLimiter struct {
+	// maxValues and maxSeries are the limits, 0 is unlimited.
+	maxValues int
+	maxSeries int
+
+	// labels identify the database. They're never limited, like the status.
+	labels prometheus.Labels
+
+	dropped *prometheus.CounterVec
+
+	// values contains the values of every label, by metric and label name.
+	values map[string]map[string]map[string]struct{}
+	// series contains the keys of the series (see seriesKey) by metric.
+	series map[string]map[string]struct{}
+
+	sync.Mutex
+}
+
+// newCardinalityLimiter creates a cardinalityLimiter for the database
+// identified by labels based on opts, or returns nil if both limits are
+// disabled.
+func newCardinalityLimiter(opts *pluginOpts, dropped *prometheus.CounterVec, labels prometheus.Labels) *cardinalityLimiter {
+	if opts.cardinalityMaxValues <= 0 && opts.cardinalityMaxSeries <= 0 {
+		return nil
+	}
+
+	return &cardinalityLimiter{
+		maxValues: opts.cardinalityMaxValues,
+		maxSeries: opts.cardinalityMaxSeries,
+		labels:    labels,
+		dropped:   dropped,
+		values:    make(map[string]map[string]map[string]struct{}),
+		series:    make(map[string]map[string]struct{}),
+	}
+}
+
+// limit returns labels of a series of metric, with the values exceeding a
+// limit replaced by overflowValue. labels is never modified.
+func (l *cardinalityLimiter) limit(metric string, labels prometheus.Labels) prometheus.Labels {
+	if l == nil {
+		return labels
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	result := make(prometheus.Labels, len(labels))
+	for name, value := range labels {
+		if !l.fixed(name) {
+			value = l.limitValue(metric, name, value)
+		}
+		result[name] = value
+	}
+
+	if l.maxSeries <= 0 {
+		return result
+	}
+
+	series, ok := l.series[metric]
+	if !ok {
+		series = make(map[string]struct{})
+		l.series[metric] = series
+	}
+
+	key := l.seriesKey(result)
+	if _, exists := series[key]; exists || len(series) < l.maxSeries {
+		series[key] = struct{}{}
+		return result
+	}
+
+	// The series is folded into a single overflow series, which is allowed
+	// to exceed the limit.
+	for name, value := range result {
+		if l.fixed(name) || value == overflowValue {
+			continue
+		}
+
+		result[name] = overflowValue
+		l.drop(metric, name)
+	}
+	series[l.seriesKey(result)] = struct{}{}
+
+	return result
+}
+
+// limitValue returns value, or overflowValue if label of metric already has
+// the maximum amount of other values. Must be called with l locked.
+func (l *cardinalityLimiter) limitValue(metric, label, value string) string {
+	labels, ok := l.values[metric]
+	if !ok {
+		labels = make(map[string]map[string]struct{})
+		l.values[metric] = labels
+	}
+
+	values, ok := labels[label]
+	if !ok {
+		values = make(map[string]struct{})
+		labels[label] = values
+	}
+
+	if _, exists := values[value]; exists {
+		return value
+	}
+
+	if l.maxValues > 0 && len(values) >= l.maxValues {
+		l.drop(metric, label)
+		return overflowValue
+	}
+
+	values[value] = struct{}{}
+	return value
+}
+
+// drop counts a value of label of metric that was replaced by overflowValue.
+func (l *cardinalityLimiter) drop(metric, label string) {
+	l.dropped.
+		With(mergeLabels(prometheus.Labels{labelMetric: metric, labelLabel: label}, l.labels)).
+		Inc()
+}
+
+// fixed returns true if label is never limited.
+func (l *cardinalityLimiter) fixed(label string) bool {
+	_, fixed := l.labels[label]
+	return fixed || label == labelStatus
+}
+
+// seriesKey returns a key identifying the dynamic labels in labels.
+func (l *cardinalityLimiter) seriesKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !l.fixed(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+
+	return key.String()
+}
+
+// reset forgets all values and series, e.g. after they were deleted.
+func (l *cardinalityLimiter) reset() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.values = make(map[string]map[string]map[string]struct{})
+	l.series = make(map[string]map[string]struct{})
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	qc, err := newQueryCounters(prometheus.NewRegistry(), "cardinality_test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := prometheus.Labels{labelDatabase: "my_db", labelDriver: "pq"}
+	limiter := newCardinalityLimiter(getOpts([]RegisterOpt{WithCardinalityLimit(2, 3)}), qc.droppedLabelValues, database)
+
+	series := []struct {
+		table, kind string
+		want        string
+	}{
+		{"users", "plain", "table=users,kind=plain"},
+		{"orders", "plain", "table=orders,kind=plain"},
+		// The third table exceeds the values limit.
+		{"items", "plain", "table=__overflow__,kind=plain"},
+		{"users", "plain", "table=users,kind=plain"},
+		// The fourth series exceeds the series limit.
+		{"orders", "upsert", "table=__overflow__,kind=__overflow__"},
+		{"users", "plain", "table=users,kind=plain"},
+	}
+
+	for _, s := range series {
+		labels := mergeLabels(prometheus.Labels{labelTable: s.table, "kind": s.kind, labelStatus: "success"}, database)
+		got := limiter.limit(metricNPlusOneDetected, labels)
+
+		if got[labelDatabase] != "my_db" || got[labelStatus] != "success" {
+			t.Fatalf("fixed labels were limited: %v", got)
+		}
+		if got := "table=" + got[labelTable] + ",kind=" + got["kind"]; got != s.want {
+			t.Fatalf("expected %v, got %v", s.want, got)
+		}
+	}
+
+	want := `
+		# HELP cardinality_test_dropped_label_values_total ` + helpDroppedLabelValues + `
+		# TYPE cardinality_test_dropped_label_values_total counter
+		cardinality_test_dropped_label_values_total{database="my_db",driver="pq",label="kind",metric="n_plus_one_detected_total"} 1
+		cardinality_test_dropped_label_values_total{database="my_db",driver="pq",label="table",metric="n_plus_one_detected_total"} 2
+	`
+	if err := testutil.CollectAndCompare(qc.droppedLabelValues, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
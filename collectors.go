@@ -22,139 +22,372 @@ import (
 )
 
 type globalCollectors struct {
-	query    map[string]*queryCounters
-	database map[string]*databaseGauges
+	query      map[collectorsKey]*queryCounters
+	database   map[collectorsKey]*databaseGauges
+	registered map[collectorsKey]prometheus.GaugeFunc
+
+	// all contains every collector registered by gormetrics per registerer,
+	// see Handler.
+	all map[prometheus.Registerer][]prometheus.Collector
 
 	sync.Mutex
 }
 
+// collectorsKey identifies cached collectors, which are created once per
+// Prometheus registerer and namespace.
+type collectorsKey struct {
+	registerer prometheus.Registerer
+	namespace  string
+
+	// instance is true if the collectors have an instance label, model if the
+	// query counters have a model label.
+	instance bool
+	model    bool
+}
+
 // collectors is used by newQueryCounters and newDatabaseGauges to cache existing
 // collectors so none are registered in Prometheus twice (this causes an error).
 var collectors = globalCollectors{
-	query:    make(map[string]*queryCounters),
-	database: make(map[string]*databaseGauges),
+	query:      make(map[collectorsKey]*queryCounters),
+	database:   make(map[collectorsKey]*databaseGauges),
+	registered: make(map[collectorsKey]prometheus.GaugeFunc),
+	all:        make(map[prometheus.Registerer][]prometheus.Collector),
 }
 
 // queryCounters contains all histograms that are exported.
 type queryCounters struct {
-	all             *prometheus.CounterVec
-	allDuration     *prometheus.HistogramVec
-	creates         *prometheus.CounterVec
-	createsDuration *prometheus.HistogramVec
-	deletes         *prometheus.CounterVec
-	deletesDuration *prometheus.HistogramVec
-	queries         *prometheus.CounterVec
-	queriesDuration *prometheus.HistogramVec
-	updates         *prometheus.CounterVec
-	updatesDuration *prometheus.HistogramVec
-}
-
-func newQueryCounters(namespace string) (*queryCounters, error) {
+	all                      *prometheus.CounterVec
+	allDuration              *prometheus.HistogramVec
+	allExecutionDuration     *prometheus.HistogramVec
+	creates                  *prometheus.CounterVec
+	createsDuration          *prometheus.HistogramVec
+	createsExecutionDuration *prometheus.HistogramVec
+	deletes                  *prometheus.CounterVec
+	deletesDuration          *prometheus.HistogramVec
+	deletesExecutionDuration *prometheus.HistogramVec
+	queries                  *prometheus.CounterVec
+	queriesDuration          *prometheus.HistogramVec
+	queriesExecutionDuration *prometheus.HistogramVec
+	updates                  *prometheus.CounterVec
+	updatesDuration          *prometheus.HistogramVec
+	updatesExecutionDuration *prometheus.HistogramVec
+	nPlusOneDetected         *prometheus.CounterVec
+	droppedLabelValues       *prometheus.CounterVec
+
+	associationStatements         *prometheus.CounterVec
+	associationStatementsDuration *prometheus.HistogramVec
+
+	batches   *prometheus.CounterVec
+	batchSize *prometheus.HistogramVec
+}
+
+func newQueryCounters(registerer prometheus.Registerer, namespace string, instance, model bool) (*queryCounters, error) {
 	collectors.Lock()
 	defer collectors.Unlock()
 
-	if gc, exists := collectors.query[namespace]; exists {
+	key := collectorsKey{registerer: registerer, namespace: namespace, instance: instance, model: model}
+	if gc, exists := collectors.query[key]; exists {
 		return gc, nil
 	}
 
 	cc := counterVecCreator{
 		namespace: namespace,
-		labels: []string{
-			labelDatabase,
-			labelDriver,
-			labelStatus,
-		},
+		labels:    queryLabels(instance, model, labelStatus),
 	}
 
 	hc := histogramVecCreator{
 		namespace: namespace,
-		labels: []string{
-			labelDatabase,
-			labelDriver,
-			labelStatus,
-		},
+		labels:    queryLabels(instance, model, labelStatus),
+	}
+
+	kc := counterVecCreator{
+		namespace: namespace,
+		labels:    queryLabels(instance, model, labelKind, labelStatus),
+	}
+
+	khc := histogramVecCreator{
+		namespace: namespace,
+		labels:    queryLabels(instance, model, labelKind, labelStatus),
+	}
+
+	bc := counterVecCreator{
+		namespace: namespace,
+		labels:    queryLabels(instance, model, labelKind),
+	}
+
+	bhc := histogramVecCreator{
+		namespace: namespace,
+		labels:    queryLabels(instance, model, labelKind),
+		buckets:   batchSizeBuckets,
+	}
+
+	tc := counterVecCreator{
+		namespace: namespace,
+		labels:    append(databaseLabels(instance), labelTable),
+	}
+
+	dc := counterVecCreator{
+		namespace: namespace,
+		labels:    append(databaseLabels(instance), labelMetric, labelLabel),
+	}
+
+	ac := counterVecCreator{
+		namespace: namespace,
+		labels:    append(databaseLabels(instance), labelOrigin, labelAssociation, labelStatus),
+	}
+
+	ahc := histogramVecCreator{
+		namespace: namespace,
+		labels:    append(databaseLabels(instance), labelOrigin, labelAssociation, labelStatus),
 	}
 
 	qc := queryCounters{
-		all:             cc.new(metricAllTotal, helpAllTotal),
-		allDuration:     hc.new(metricAllDuration, helpAllDuration),
-		creates:         cc.new(metricCreatesTotal, helpCreatesTotal),
-		createsDuration: hc.new(metricCreatesDuration, helpCreatesDuration),
-		deletes:         cc.new(metricDeletesTotal, helpDeletesTotal),
-		deletesDuration: hc.new(metricDeletesDuration, helpDeletesDuration),
-		queries:         cc.new(metricQueriesTotal, helpQueriesTotal),
-		queriesDuration: hc.new(metricQueriesDuration, helpQueriesDuration),
-		updates:         cc.new(metricUpdatesTotal, helpUpdatesTotal),
-		updatesDuration: hc.new(metricUpdatesDuration, helpUpdatesDuration),
-	}
-
-	if err := registerCollectors(
+		all:                      cc.new(metricAllTotal, helpAllTotal),
+		allDuration:              hc.new(metricAllDuration, helpAllDuration),
+		allExecutionDuration:     hc.new(metricAllExecutionDuration, helpAllExecutionDuration),
+		creates:                  kc.new(metricCreatesTotal, helpCreatesTotal),
+		createsDuration:          khc.new(metricCreatesDuration, helpCreatesDuration),
+		createsExecutionDuration: khc.new(metricCreatesExecutionDuration, helpCreatesExecutionDuration),
+		deletes:                  kc.new(metricDeletesTotal, helpDeletesTotal),
+		deletesDuration:          khc.new(metricDeletesDuration, helpDeletesDuration),
+		deletesExecutionDuration: khc.new(metricDeletesExecutionDuration, helpDeletesExecutionDuration),
+		queries:                  cc.new(metricQueriesTotal, helpQueriesTotal),
+		queriesDuration:          hc.new(metricQueriesDuration, helpQueriesDuration),
+		queriesExecutionDuration: hc.new(metricQueriesExecutionDuration, helpQueriesExecutionDuration),
+		updates:                  kc.new(metricUpdatesTotal, helpUpdatesTotal),
+		updatesDuration:          khc.new(metricUpdatesDuration, helpUpdatesDuration),
+		updatesExecutionDuration: khc.new(metricUpdatesExecutionDuration, helpUpdatesExecutionDuration),
+		nPlusOneDetected:         tc.new(metricNPlusOneDetected, helpNPlusOneDetected),
+		droppedLabelValues:       dc.new(metricDroppedLabelValues, helpDroppedLabelValues),
+
+		associationStatements:         ac.new(metricAssociationStatementsTotal, helpAssociationStatementsTotal),
+		associationStatementsDuration: ahc.new(metricAssociationStatementsDuration, helpAssociationStatementsDuration),
+
+		batches:   bc.new(metricBatchesTotal, helpBatchesTotal),
+		batchSize: bhc.new(metricBatchSize, helpBatchSize),
+	}
+
+	if err := registerCollectors(registerer, qc.collectors()...); err != nil {
+		return nil, errors.Wrap(err, "could not register collectors")
+	}
+
+	collectors.query[key] = &qc
+
+	return collectors.query[key], nil
+}
+
+// collectors returns all collectors in qc.
+func (qc *queryCounters) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		qc.all,
 		qc.allDuration,
+		qc.allExecutionDuration,
 		qc.creates,
 		qc.createsDuration,
+		qc.createsExecutionDuration,
 		qc.deletes,
 		qc.deletesDuration,
+		qc.deletesExecutionDuration,
 		qc.queries,
 		qc.queriesDuration,
+		qc.queriesExecutionDuration,
 		qc.updates,
 		qc.updatesDuration,
-	); err != nil {
-		return nil, errors.Wrap(err, "could not register collectors")
+		qc.updatesExecutionDuration,
+		qc.nPlusOneDetected,
+		qc.droppedLabelValues,
+		qc.associationStatements,
+		qc.associationStatementsDuration,
+		qc.batches,
+		qc.batchSize,
 	}
-
-	collectors.query[namespace] = &qc
-
-	return collectors.query[namespace], nil
 }
 
 type databaseGauges struct {
 	idle  *prometheus.GaugeVec
 	inUse *prometheus.GaugeVec
 	open  *prometheus.GaugeVec
+
+	maxOpen         *prometheus.GaugeVec
+	maxIdle         *prometheus.GaugeVec
+	connMaxLifetime *prometheus.GaugeVec
+	connMaxIdleTime *prometheus.GaugeVec
+
+	up           *prometheus.GaugeVec
+	pingFailures *prometheus.GaugeVec
+	pingDuration *prometheus.HistogramVec
 }
 
-func newDatabaseGauges(namespace string) (*databaseGauges, error) {
+func newDatabaseGauges(registerer prometheus.Registerer, namespace string, instance bool) (*databaseGauges, error) {
 	collectors.Lock()
 	defer collectors.Unlock()
 
-	if gc, exists := collectors.database[namespace]; exists {
+	key := collectorsKey{registerer: registerer, namespace: namespace, instance: instance}
+	if gc, exists := collectors.database[key]; exists {
 		return gc, nil
 	}
 
 	vecCreator := gaugeVecCreator{
 		namespace: namespace,
-		labels: []string{
-			labelDatabase,
-			labelDriver,
-		},
+		labels:    databaseLabels(instance),
+	}
+
+	hc := histogramVecCreator{
+		namespace: namespace,
+		labels:    append(databaseLabels(instance), labelStatus),
 	}
 
 	dg := databaseGauges{
 		idle:  vecCreator.new(metricIdleConnections, helpIdleConnections),
 		inUse: vecCreator.new(metricInUseConnections, helpInUseConnections),
 		open:  vecCreator.new(metricOpenConnections, helpOpenConnections),
+
+		maxOpen:         vecCreator.new(metricMaxOpenConnections, helpMaxOpenConnections),
+		maxIdle:         vecCreator.new(metricMaxIdleConnections, helpMaxIdleConnections),
+		connMaxLifetime: vecCreator.new(metricConnectionMaxLifetime, helpConnectionMaxLifetime),
+		connMaxIdleTime: vecCreator.new(metricConnectionMaxIdleTime, helpConnectionMaxIdleTime),
+
+		up:           vecCreator.new(metricUp, helpUp),
+		pingFailures: vecCreator.new(metricPingFailures, helpPingFailures),
+		pingDuration: hc.new(metricPingDuration, helpPingDuration),
+	}
+
+	if err := registerCollectors(registerer, dg.collectors()...); err != nil {
+		return nil, err
 	}
 
-	if err := registerCollectors(
+	collectors.database[key] = &dg
+
+	return collectors.database[key], nil
+}
+
+// collectors returns all collectors in dg.
+func (dg *databaseGauges) collectors() []prometheus.Collector {
+	return append(dg.connections(), dg.up, dg.pingFailures, dg.pingDuration)
+}
+
+// connections returns the collectors of the connection statistics in dg.
+func (dg *databaseGauges) connections() []prometheus.Collector {
+	return []prometheus.Collector{
 		dg.idle,
 		dg.inUse,
 		dg.open,
-	); err != nil {
-		return nil, err
+		dg.maxOpen,
+		dg.maxIdle,
+		dg.connMaxLifetime,
+		dg.connMaxIdleTime,
 	}
+}
 
-	collectors.database[namespace] = &dg
+// newRegisteredDatabasesGauge registers a gauge of the active databases
+// registered with registerer and namespace, unless it already exists.
+func newRegisteredDatabasesGauge(registerer prometheus.Registerer, namespace string) error {
+	collectors.Lock()
+	defer collectors.Unlock()
 
-	return collectors.database[namespace], nil
+	key := collectorsKey{registerer: registerer, namespace: namespace}
+	if _, exists := collectors.registered[key]; exists {
+		return nil
+	}
+
+	gauge := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      metricRegisteredDatabases,
+			Help:      helpRegisteredDatabases,
+		},
+		func() float64 {
+			return float64(registeredDatabases.active(registerer, namespace))
+		},
+	)
+
+	if err := registerCollectors(registerer, gauge); err != nil {
+		return err
+	}
+
+	collectors.registered[key] = gauge
+
+	return nil
+}
+
+// databaseLabels returns the names of the labels identifying a database, see
+// extraInfo.labels. A new slice is returned, so it can be appended to.
+func databaseLabels(instance bool) []string {
+	if instance {
+		return []string{labelDatabase, labelDriver, labelInstance}
+	}
+	return []string{labelDatabase, labelDriver}
+}
+
+// unregisterCollectors unregisters multiple instances of prometheus.Collector
+// from registerer, see registerCollectors. Must be called with collectors
+// locked.
+func unregisterCollectors(registerer prometheus.Registerer, cs ...prometheus.Collector) {
+	for _, c := range cs {
+		registerer.Unregister(c)
+
+		all := collectors.all[registerer]
+		for i, other := range all {
+			if other == c {
+				collectors.all[registerer] = append(all[:i], all[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// releaseCollectors unregisters the cached collectors of registerer and
+// namespace from registerer and forgets them, once no database is registered
+// with them anymore.
+func releaseCollectors(registerer prometheus.Registerer, namespace string) {
+	collectors.Lock()
+	defer collectors.Unlock()
+
+	for key, qc := range collectors.query {
+		if key.registerer == registerer && key.namespace == namespace {
+			unregisterCollectors(registerer, qc.collectors()...)
+			delete(collectors.query, key)
+		}
+	}
+
+	for key, dg := range collectors.database {
+		if key.registerer == registerer && key.namespace == namespace {
+			unregisterCollectors(registerer, dg.collectors()...)
+			delete(collectors.database, key)
+		}
+	}
+
+	for key, gauge := range collectors.registered {
+		if key.registerer == registerer && key.namespace == namespace {
+			unregisterCollectors(registerer, gauge)
+			delete(collectors.registered, key)
+		}
+	}
+
+	if len(collectors.all[registerer]) == 0 {
+		delete(collectors.all, registerer)
+	}
+}
+
+// queryLabels returns the names of the labels of the query metrics: the labels
+// identifying a database, the model (if enabled) and extra.
+func queryLabels(instance, model bool, extra ...string) []string {
+	labels := databaseLabels(instance)
+	if model {
+		labels = append(labels, labelModel)
+	}
+	return append(labels, extra...)
 }
 
-// registerCollectors registers multiple instances of prometheus.Collector.
-func registerCollectors(collectors ...prometheus.Collector) error {
-	for _, c := range collectors {
-		if err := prometheus.Register(c); err != nil {
+// registerCollectors registers multiple instances of prometheus.Collector with
+// registerer and keeps track of them for Handler. Must be called with
+// collectors locked.
+func registerCollectors(registerer prometheus.Registerer, cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := registerer.Register(c); err != nil {
 			return err
 		}
+		collectors.all[registerer] = append(collectors.all[registerer], c)
 	}
 
 	return nil
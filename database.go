@@ -15,6 +15,7 @@
 package gormetrics
 
 import (
+	"context"
 	"database/sql"
 	"sync"
 	"time"
@@ -27,70 +28,231 @@ type database struct {
 	name       string
 	driverName string
 
+	// labels identify the database, see extraInfo.labels.
+	labels prometheus.Labels
+
+	// settings is nil if no pool settings were declared.
+	settings *PoolSettings
+
 	db *sql.DB
 	sync.Mutex
 }
 
 // newDatabase creates a new database wrapper containing the name of the database,
-// it's driver and the (sql) database itself.
-func newDatabase(info extraInfo, db *sql.DB) *database {
+// it's driver, the declared pool settings and the (sql) database itself.
+func newDatabase(info extraInfo, db *sql.DB, settings *PoolSettings) *database {
 	return &database{
 		name:       info.dbName,
 		driverName: info.driverName,
+		labels:     info.labels(),
+		settings:   settings,
 		db:         db,
 	}
 }
 
-// collectConnectionStats collects database connections for Prometheus to scrape.
-func (d *database) collectConnectionStats(counters *databaseGauges) {
+// applyPoolSettings applies the declared pool settings to the pool, so the
+// exported settings match it.
+func (d *database) applyPoolSettings() {
+	if d.settings == nil {
+		return
+	}
+
+	d.db.SetMaxIdleConns(d.settings.MaxIdleConns)
+	d.db.SetConnMaxLifetime(d.settings.ConnMaxLifetime)
+	d.db.SetConnMaxIdleTime(d.settings.ConnMaxIdleTime)
+}
+
+// checkPoolSettings logs a warning for every dangerous setting of the pool.
+func (d *database) checkPoolSettings(logger Logger) {
+	for _, warning := range checkPoolSettings(d.db.Stats(), d.settings) {
+		logger.Printf("gormetrics: database %v: %v", d.name, warning)
+	}
+}
+
+// ping checks if the database is reachable by pinging it or, if query is not
+// empty, by executing query. The query is executed on the database/sql level,
+// so it's never part of the query metrics.
+func (d *database) ping(ctx context.Context, query string) error {
+	if query == "" {
+		return d.db.PingContext(ctx)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+
+	return rows.Err()
+}
+
+// collectConnectionStats collects database connections for Prometheus to scrape,
+// and sends them to StatsD if enabled.
+func (d *database) collectConnectionStats(gauges *databaseGauges, statsd *statsdClient) {
 	d.Lock()
 	defer d.Unlock()
 
-	defaultLabels := prometheus.Labels{
-		labelDatabase: d.name,
-		labelDriver:   d.driverName,
+	defaultLabels := d.labels
+
+	set := func(gauge *prometheus.GaugeVec, name string, value float64) {
+		gauge.
+			With(defaultLabels).
+			Set(value)
+
+		statsd.gauge(name, value, defaultLabels)
 	}
 
 	stats := d.db.Stats()
 
-	counters.idle.
-		With(defaultLabels).
-		Set(float64(stats.Idle))
+	set(gauges.idle, metricIdleConnections, float64(stats.Idle))
+	set(gauges.inUse, metricInUseConnections, float64(stats.InUse))
+	set(gauges.open, metricOpenConnections, float64(stats.OpenConnections))
+	set(gauges.maxOpen, metricMaxOpenConnections, float64(stats.MaxOpenConnections))
+
+	if d.settings == nil {
+		return
+	}
 
-	counters.inUse.
-		With(defaultLabels).
-		Set(float64(stats.InUse))
+	// database/sql limits the idle connections to the maximum amount of open
+	// connections, and keeps none if the limit is negative.
+	maxIdle := d.settings.MaxIdleConns
+	if stats.MaxOpenConnections > 0 && maxIdle > stats.MaxOpenConnections {
+		maxIdle = stats.MaxOpenConnections
+	}
+	if maxIdle < 0 {
+		maxIdle = 0
+	}
 
-	counters.open.
-		With(defaultLabels).
-		Set(float64(stats.OpenConnections))
+	set(gauges.maxIdle, metricMaxIdleConnections, float64(maxIdle))
+	set(gauges.connMaxLifetime, metricConnectionMaxLifetime, d.settings.ConnMaxLifetime.Seconds())
+	set(gauges.connMaxIdleTime, metricConnectionMaxIdleTime, d.settings.ConnMaxIdleTime.Seconds())
 }
 
 // databaseMetrics is a convenience struct for exporting database metrics to Prometheus.
 type databaseMetrics struct {
 	gauges *databaseGauges
 	db     *database
+
+	// probe is nil if the health probe is disabled.
+	probe *healthProbe
+
+	// statsd is nil if the StatsD backend is disabled.
+	statsd *statsdClient
+
+	// expiry is nil if the idle TTL is disabled.
+	expiry *idleExpiry
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	// Mutex prevents collecting connection statistics while they expire.
+	sync.Mutex
 }
 
 // newDatabaseMetrics creates a new databaseMetrics instance with a database backing it
-// for statistics. Use maintain to continuously collect statistics.
-func newDatabaseMetrics(db *database, opts *pluginOpts) (*databaseMetrics, error) {
-	gauges, err := newDatabaseGauges(opts.prometheusNamespace)
+// for statistics. Use maintain to continuously collect statistics and stop to
+// stop collecting them.
+func newDatabaseMetrics(db *database, opts *pluginOpts, statsd *statsdClient, expiry *idleExpiry) (*databaseMetrics, error) {
+	gauges, err := newDatabaseGauges(opts.prometheusRegisterer, opts.prometheusNamespace, db.labels[labelInstance] != "")
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create database gauges")
 	}
 
 	return &databaseMetrics{
-		gauges: gauges,
-		db:     db,
+		gauges:  gauges,
+		db:      db,
+		probe:   newHealthProbe(opts),
+		statsd:  statsd,
+		expiry:  expiry,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}, nil
 }
 
-// maintain collects connection statistics every 3 seconds.
+// maintain collects connection statistics every 3 seconds and, if enabled,
+// runs the health probe at its interval until stop is called.
 func (d *databaseMetrics) maintain() {
+	defer close(d.stopped)
+
+	var probe sync.WaitGroup
+	defer probe.Wait()
+
+	if d.probe != nil {
+		probe.Add(1)
+		go func() {
+			defer probe.Done()
+			d.maintainProbe()
+		}()
+	}
+
 	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.collect()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// collect collects connection statistics, unless the database expired.
+func (d *databaseMetrics) collect() {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.expiry.expired() {
+		d.db.collectConnectionStats(d.gauges, d.statsd)
+	}
+}
+
+// expire deletes the connection statistics of the database, after it has been
+// idle for longer than the idle TTL. They're collected again once it's active.
+// The series of the health probe are kept.
+func (d *databaseMetrics) expire() {
+	d.Lock()
+	defer d.Unlock()
+
+	deleteSeries(d.db.labels, d.gauges.connections()...)
+}
+
+// maintainProbe probes the database immediately and at every interval of the
+// health probe until stop is called.
+func (d *databaseMetrics) maintainProbe() {
+	ticker := time.NewTicker(d.probe.interval)
+	defer ticker.Stop()
+
+	for {
+		d.probe.probe(d.db, d.gauges, d.statsd)
+
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// stop stops collecting statistics and probing the database, and waits until
+// both stopped.
+func (d *databaseMetrics) stop() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		<-d.stopped
+	})
+}
 
-	for range ticker.C {
-		d.db.collectConnectionStats(d.gauges)
+// readinessHandler creates a readinessHandler for the database.
+func (d *databaseMetrics) readinessHandler(timeout time.Duration) readinessHandler {
+	return readinessHandler{
+		db:      d.db,
+		probe:   d.probe,
+		timeout: timeout,
 	}
 }
@@ -0,0 +1,193 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type globalCollectors struct {
+	driver map[collectorsKey]*driverCollectors
+
+	// all contains every collector registered by wrapped drivers per
+	// registerer, see Collector.
+	all map[prometheus.Registerer][]prometheus.Collector
+
+	sync.Mutex
+}
+
+// collectorsKey identifies cached collectors, which are created once per
+// Prometheus registerer and namespace.
+type collectorsKey struct {
+	registerer prometheus.Registerer
+	namespace  string
+}
+
+// collectors is used by newDriverCollectors to cache existing collectors so
+// none are registered in Prometheus twice (this causes an error).
+var collectors = globalCollectors{
+	driver: make(map[collectorsKey]*driverCollectors),
+	all:    make(map[prometheus.Registerer][]prometheus.Collector),
+}
+
+// Collector returns a prometheus.Collector that collects the metrics of all
+// wrapped drivers and connectors registered with registerer (see
+// WithRegisterer). It is used by gormetrics.Handler.
+func Collector(registerer prometheus.Registerer) prometheus.Collector {
+	return registererCollectors{registerer: registerer}
+}
+
+// registererCollectors collects the collectors of registerer in collectors.all.
+// It is an unchecked collector, since the set of collectors grows as drivers
+// are wrapped.
+type registererCollectors struct {
+	registerer prometheus.Registerer
+}
+
+func (registererCollectors) Describe(chan<- *prometheus.Desc) {}
+
+func (r registererCollectors) Collect(ch chan<- prometheus.Metric) {
+	collectors.Lock()
+	all := make([]prometheus.Collector, len(collectors.all[r.registerer]))
+	copy(all, collectors.all[r.registerer])
+	collectors.Unlock()
+
+	for _, c := range all {
+		c.Collect(ch)
+	}
+}
+
+// driverCollectors contains all collectors that are exported by wrapped drivers.
+type driverCollectors struct {
+	connectionOpenDuration *prometheus.HistogramVec
+	connectionLifetime     *prometheus.HistogramVec
+	sessionResets          *prometheus.CounterVec
+	callsDuration          *prometheus.HistogramVec
+	connectionWaitDuration *prometheus.HistogramVec
+}
+
+// durationBuckets are the buckets of histograms in milliseconds, equal to the
+// buckets used by the gormetrics plugin.
+var durationBuckets = []float64{0.5, 1, 5, 10, 50, 500, 1000, 2000, 4000, 8000}
+
+// lifetimeBuckets are the buckets of the connection lifetime histogram in seconds.
+var lifetimeBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 12 * 3600, 24 * 3600}
+
+func newDriverCollectors(registerer prometheus.Registerer, namespace string) (*driverCollectors, error) {
+	collectors.Lock()
+	defer collectors.Unlock()
+
+	key := collectorsKey{registerer: registerer, namespace: namespace}
+	if dc, exists := collectors.driver[key]; exists {
+		return dc, nil
+	}
+
+	dc := driverCollectors{
+		connectionOpenDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      metricConnectionOpenDuration,
+			Help:      helpConnectionOpenDuration,
+			Buckets:   durationBuckets,
+		}, []string{labelDatabase, labelDriver, labelStatus}),
+		connectionLifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      metricConnectionLifetime,
+			Help:      helpConnectionLifetime,
+			Buckets:   lifetimeBuckets,
+		}, []string{labelDatabase, labelDriver}),
+		sessionResets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      metricSessionResetsTotal,
+			Help:      helpSessionResetsTotal,
+		}, []string{labelDatabase, labelDriver, labelStatus}),
+		callsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      metricDriverCallsDuration,
+			Help:      helpDriverCallsDuration,
+			Buckets:   durationBuckets,
+		}, []string{labelDatabase, labelDriver, labelCall, labelStatus}),
+		connectionWaitDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      metricConnectionWaitDuration,
+			Help:      helpConnectionWaitDuration,
+			Buckets:   durationBuckets,
+		}, []string{labelDatabase, labelDriver}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		dc.connectionOpenDuration,
+		dc.connectionLifetime,
+		dc.sessionResets,
+		dc.callsDuration,
+		dc.connectionWaitDuration,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, errors.Wrap(err, "could not register collectors")
+		}
+		collectors.all[registerer] = append(collectors.all[registerer], c)
+	}
+
+	collectors.driver[key] = &dc
+
+	return collectors.driver[key], nil
+}
+
+// observer records the metrics of a single wrapped driver or connector.
+type observer struct {
+	collectors *driverCollectors
+	database   string
+	driver     string
+}
+
+// status returns the value of the status label for err.
+func status(err error) string {
+	if err != nil {
+		return metricStatusFail
+	}
+	return metricStatusSuccess
+}
+
+// milliseconds returns the time elapsed since start in milliseconds.
+func milliseconds(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+func (o *observer) connectionOpened(start time.Time, err error) {
+	o.collectors.connectionOpenDuration.
+		WithLabelValues(o.database, o.driver, status(err)).
+		Observe(milliseconds(start))
+}
+
+func (o *observer) connectionClosed(opened time.Time) {
+	o.collectors.connectionLifetime.
+		WithLabelValues(o.database, o.driver).
+		Observe(time.Since(opened).Seconds())
+}
+
+func (o *observer) sessionReset(err error) {
+	o.collectors.sessionResets.
+		WithLabelValues(o.database, o.driver, status(err)).
+		Add(1)
+}
+
+func (o *observer) call(call string, start time.Time, err error) {
+	o.collectors.callsDuration.
+		WithLabelValues(o.database, o.driver, call, status(err)).
+		Observe(milliseconds(start))
+}
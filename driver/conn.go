@@ -0,0 +1,220 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// conn is an instrumented driver.Conn. It implements all optional interfaces
+// database/sql looks for, falling back to the same behaviour as database/sql
+// if the wrapped connection doesn't implement them.
+type conn struct {
+	driver.Conn
+	observer *observer
+	opened   time.Time
+}
+
+func newConn(c driver.Conn, o *observer) *conn {
+	return &conn{
+		Conn:     c,
+		observer: o,
+		opened:   time.Now(),
+	}
+}
+
+// Close closes the connection and records its lifetime.
+func (c *conn) Close() error {
+	c.observer.connectionClosed(c.opened)
+	return c.Conn.Close()
+}
+
+// Prepare prepares a statement.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	start := time.Now()
+	stmt, err := c.Conn.Prepare(query)
+	c.observer.call(callPrepare, start, err)
+	return stmt, err
+}
+
+// PrepareContext prepares a statement.
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.observer.observeWait(ctx)
+
+	pc, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Prepare(query)
+	}
+
+	start := time.Now()
+	stmt, err := pc.PrepareContext(ctx, query)
+	c.observer.call(callPrepare, start, err)
+	return stmt, err
+}
+
+// Begin starts a transaction.
+//
+// Deprecated: only used for drivers that don't implement driver.ConnBeginTx.
+func (c *conn) Begin() (driver.Tx, error) {
+	start := time.Now()
+	tx, err := c.Conn.Begin() //nolint:staticcheck // Wrapped drivers may only implement Begin.
+	c.observer.call(callBeginTx, start, err)
+	return tx, err
+}
+
+// BeginTx starts a transaction.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.observer.observeWait(ctx)
+
+	bt, ok := c.Conn.(driver.ConnBeginTx)
+	if !ok {
+		// Same restrictions as database/sql applies to drivers without BeginTx.
+		if opts.Isolation != 0 {
+			return nil, errors.New("sql: driver does not support non-default isolation level")
+		}
+		if opts.ReadOnly {
+			return nil, errors.New("sql: driver does not support read-only transactions")
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Begin()
+	}
+
+	start := time.Now()
+	tx, err := bt.BeginTx(ctx, opts)
+	c.observer.call(callBeginTx, start, err)
+	return tx, err
+}
+
+// Ping verifies the connection is still alive, if supported by the driver.
+func (c *conn) Ping(ctx context.Context) error {
+	c.observer.observeWait(ctx)
+
+	p, ok := c.Conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := p.Ping(ctx)
+	c.observer.call(callPing, start, err)
+	return err
+}
+
+// ResetSession resets the session before the connection is reused, if
+// supported by the driver.
+func (c *conn) ResetSession(ctx context.Context) error {
+	c.observer.observeWait(ctx)
+
+	sr, ok := c.Conn.(driver.SessionResetter)
+	if !ok {
+		return nil
+	}
+
+	err := sr.ResetSession(ctx)
+	c.observer.sessionReset(err)
+	return err
+}
+
+// IsValid reports whether the connection can be reused.
+func (c *conn) IsValid() bool {
+	v, ok := c.Conn.(driver.Validator)
+	if !ok {
+		return true
+	}
+	return v.IsValid()
+}
+
+// ExecContext executes a query without returning rows, if supported by the
+// driver. Otherwise driver.ErrSkip makes database/sql prepare the statement.
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.observer.observeWait(ctx)
+
+	if ec, ok := c.Conn.(driver.ExecerContext); ok {
+		return ec.ExecContext(ctx, query, args)
+	}
+
+	e, ok := c.Conn.(driver.Execer) //nolint:staticcheck // Wrapped drivers may only implement Execer.
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return e.Exec(query, values)
+}
+
+// QueryContext executes a query returning rows, if supported by the driver.
+// Otherwise driver.ErrSkip makes database/sql prepare the statement.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.observer.observeWait(ctx)
+
+	if qc, ok := c.Conn.(driver.QueryerContext); ok {
+		return qc.QueryContext(ctx, query, args)
+	}
+
+	q, ok := c.Conn.(driver.Queryer) //nolint:staticcheck // Wrapped drivers may only implement Queryer.
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return q.Query(query, values)
+}
+
+// CheckNamedValue checks arguments using the driver, if supported. Otherwise
+// driver.ErrSkip makes database/sql use its default conversion.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// namedValuesToValues converts arguments for drivers without context support,
+// which don't support named arguments either.
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
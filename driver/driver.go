@@ -0,0 +1,159 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driver wraps database/sql drivers to collect connection-level metrics
+// that GORM callbacks can't see: opening (dialing) connections, waiting for the
+// connection pool, session resets, the lifetime of connections and ping,
+// prepare and begin transaction calls.
+//
+// The metrics use the same namespace and database and driver labels as the
+// gormetrics plugin, so both can be combined:
+//
+//	connector, _ := pq.NewConnector(dsn)
+//	sqlDB := sql.OpenDB(driver.WrapConnector(connector, "my_database"))
+//	db, _ := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+//	_ = gormetrics.Register(db, "my_database")
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/survivorbat/gormetrics/internal/drivername"
+)
+
+// Wrap wraps d so metrics are collected for all connections it opens. The
+// returned driver can be registered using sql.Register. dbName is used as the
+// value of the database label.
+// Panics if the metrics can't be registered with Prometheus.
+func Wrap(d driver.Driver, dbName string, opts ...Opt) driver.Driver {
+	return &wrappedDriver{
+		Driver:   d,
+		observer: newObserver(d, dbName, opts),
+	}
+}
+
+// WrapConnector wraps c so metrics are collected for all connections it opens.
+// The returned connector can be used with sql.OpenDB. dbName is used as the
+// value of the database label.
+// Panics if the metrics can't be registered with Prometheus.
+func WrapConnector(c driver.Connector, dbName string, opts ...Opt) driver.Connector {
+	return &connector{
+		Connector: c,
+		observer:  newObserver(c.Driver(), dbName, opts),
+	}
+}
+
+// newObserver creates an observer for d configured with opts.
+func newObserver(d driver.Driver, dbName string, opts []Opt) *observer {
+	atomic.StoreInt32(&wrapped, 1)
+
+	o := getOpts(opts)
+
+	c, err := newDriverCollectors(o.prometheusRegisterer, o.prometheusNamespace)
+	if err != nil {
+		panic(errors.Wrap(err, "could not create driver collectors"))
+	}
+
+	driverName := o.driverName
+	if driverName == "" {
+		driverName = drivername.Lookup(d)
+	}
+
+	return &observer{
+		collectors: c,
+		database:   dbName,
+		driver:     driverName,
+	}
+}
+
+// wrappedDriver is a driver.Driver of which all connections are instrumented.
+type wrappedDriver struct {
+	driver.Driver
+	observer *observer
+}
+
+// Open opens a new instrumented connection.
+func (d *wrappedDriver) Open(name string) (driver.Conn, error) {
+	start := time.Now()
+	c, err := d.Driver.Open(name)
+	d.observer.connectionOpened(start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(c, d.observer), nil
+}
+
+// OpenConnector returns an instrumented connector for name. If the wrapped
+// driver is not a driver.DriverContext, the connector uses Open.
+func (d *wrappedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &connector{Connector: c, observer: d.observer}, nil
+	}
+
+	return &connector{
+		Connector: dsnConnector{dsn: name, driver: d.Driver},
+		observer:  d.observer,
+	}, nil
+}
+
+// connector is a driver.Connector of which all connections are instrumented.
+type connector struct {
+	driver.Connector
+	observer *observer
+}
+
+// Connect opens a new instrumented connection.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.observer.observeWait(ctx)
+
+	start := time.Now()
+	conn, err := c.Connector.Connect(ctx)
+	c.observer.connectionOpened(start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, c.observer), nil
+}
+
+// Driver returns the driver of the wrapped connector, so the driver name can
+// be resolved by database/sql users such as gormetrics.
+func (c *connector) Driver() driver.Driver {
+	return c.Connector.Driver()
+}
+
+// dsnConnector is a driver.Connector for drivers that don't implement
+// driver.DriverContext, like the connector database/sql uses internally.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var errFake = errors.New("fake error")
+
+// fakeDriver opens fakeConns, or fails with err.
+type fakeDriver struct {
+	err error
+
+	// context makes the driver open fakeContextConns.
+	context bool
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.context {
+		return &fakeContextConn{}, nil
+	}
+	return &fakeConn{}, nil
+}
+
+// fakeConnector connects using its driver.
+type fakeConnector struct {
+	driver fakeDriver
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open("")
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// fakeConn only implements driver.Conn, so conn falls back to its methods.
+type fakeConn struct {
+	prepared, begun int
+	closed          bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	c.prepared++
+	return fakeStmt{}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.begun++
+	return fakeTx{}, nil
+}
+
+// fakeContextConn implements the optional interfaces database/sql looks for,
+// failing with err.
+type fakeContextConn struct {
+	fakeConn
+	err error
+}
+
+func (c *fakeContextConn) PrepareContext(context.Context, string) (driver.Stmt, error) {
+	return fakeStmt{}, c.err
+}
+
+func (c *fakeContextConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{}, c.err
+}
+
+func (c *fakeContextConn) Ping(context.Context) error {
+	return c.err
+}
+
+func (c *fakeContextConn) ResetSession(context.Context) error {
+	return c.err
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string         { return nil }
+func (fakeRows) Close() error              { return nil }
+func (fakeRows) Next([]driver.Value) error { return io.EOF }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+// newTestObserver creates an observer registered with a new registry.
+func newTestObserver(t *testing.T) *observer {
+	t.Helper()
+	return newObserver(fakeDriver{}, "test", []Opt{WithRegisterer(prometheus.NewRegistry()), WithDriverName("fake")})
+}
+
+// observations returns the amount of observations of the histogram in vec
+// with labels.
+func observations(t *testing.T, vec *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := vec.WithLabelValues(labels...).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestWrapOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+	}{
+		{name: "success", wantStatus: metricStatusSuccess},
+		{name: "fail", err: errFake, wantStatus: metricStatusFail},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			d := Wrap(fakeDriver{err: tc.err}, "test", WithRegisterer(registry), WithDriverName("fake"))
+			c, err := d.(driver.DriverContext).OpenConnector("dsn")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, open := range []func() (driver.Conn, error){
+				func() (driver.Conn, error) { return d.Open("dsn") },
+				func() (driver.Conn, error) { return c.Connect(context.Background()) },
+			} {
+				c, err := open()
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v, want %v", err, tc.err)
+				}
+				if _, ok := c.(*conn); err == nil && !ok {
+					t.Fatalf("got connection %T, want it to be instrumented", c)
+				}
+			}
+
+			o := d.(*wrappedDriver).observer
+			if got := observations(t, o.collectors.connectionOpenDuration, "test", "fake", tc.wantStatus); got != 2 {
+				t.Fatalf("got %d observed dials, want 2", got)
+			}
+		})
+	}
+}
+
+func TestWrapConnector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := WrapConnector(fakeConnector{}, "test", WithRegisterer(registry), WithDriverName("fake"))
+
+	if _, ok := c.Driver().(fakeDriver); !ok {
+		t.Fatalf("got driver %T, want the driver of the wrapped connector", c.Driver())
+	}
+
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	o := c.(*connector).observer
+	if got := observations(t, o.collectors.connectionOpenDuration, "test", "fake", metricStatusSuccess); got != 1 {
+		t.Fatalf("got %d observed dials, want 1", got)
+	}
+}
+
+func TestConnFallbacks(t *testing.T) {
+	o := newTestObserver(t)
+	fake := &fakeConn{}
+	c := newConn(fake, o)
+	ctx := context.Background()
+
+	if _, err := c.PrepareContext(ctx, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.BeginTx(ctx, driver.TxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.prepared != 1 || fake.begun != 1 {
+		t.Fatalf("got %d prepares and %d begins, want 1 each", fake.prepared, fake.begun)
+	}
+
+	if _, err := c.BeginTx(ctx, driver.TxOptions{ReadOnly: true}); err == nil {
+		t.Fatal("expected read-only transactions to be unsupported")
+	}
+	if _, err := c.BeginTx(ctx, driver.TxOptions{Isolation: 1}); err == nil {
+		t.Fatal("expected isolation levels to be unsupported")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.PrepareContext(canceled, "SELECT 1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// Ping and session resets are no-ops if the driver doesn't support them.
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResetSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsValid() {
+		t.Fatal("expected connection to be valid")
+	}
+
+	for call, want := range map[string]uint64{callPrepare: 1, callBeginTx: 1, callPing: 0} {
+		if got := observations(t, o.collectors.callsDuration, "test", "fake", call, metricStatusSuccess); got != want {
+			t.Fatalf("%s: got %d observed calls, want %d", call, got, want)
+		}
+	}
+	if n := testutil.CollectAndCount(o.collectors.sessionResets); n != 0 {
+		t.Fatalf("got %d session reset series, want 0", n)
+	}
+}
+
+func TestConnCalls(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+	}{
+		{name: "success", wantStatus: metricStatusSuccess},
+		{name: "fail", err: errFake, wantStatus: metricStatusFail},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newTestObserver(t)
+			c := newConn(&fakeContextConn{err: tc.err}, o)
+			ctx := context.Background()
+
+			_, _ = c.PrepareContext(ctx, "SELECT 1")
+			_, _ = c.BeginTx(ctx, driver.TxOptions{ReadOnly: true})
+			_ = c.Ping(ctx)
+			_ = c.ResetSession(ctx)
+
+			for _, call := range []string{callPrepare, callBeginTx, callPing} {
+				if got := observations(t, o.collectors.callsDuration, "test", "fake", call, tc.wantStatus); got != 1 {
+					t.Fatalf("%s: got %d observed calls, want 1", call, got)
+				}
+			}
+			if got := testutil.ToFloat64(o.collectors.sessionResets.WithLabelValues("test", "fake", tc.wantStatus)); got != 1 {
+				t.Fatalf("got %v session resets, want 1", got)
+			}
+		})
+	}
+}
+
+func TestConnLifetime(t *testing.T) {
+	o := newTestObserver(t)
+	fake := &fakeConn{}
+	c := newConn(fake, o)
+	c.opened = time.Now().Add(-time.Minute)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.closed {
+		t.Fatal("expected wrapped connection to be closed")
+	}
+
+	var m dto.Metric
+	if err := o.collectors.connectionLifetime.WithLabelValues("test", "fake").(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram(); got.GetSampleCount() != 1 || got.GetSampleSum() < 60 {
+		t.Fatalf("got %d lifetimes summing to %vs, want 1 of at least 60s", got.GetSampleCount(), got.GetSampleSum())
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	first, err := newDriverCollectors(registry, "collectors_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newDriverCollectors(registry, "collectors_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected collectors to be reused for the same registerer and namespace")
+	}
+
+	other, err := newDriverCollectors(prometheus.NewRegistry(), "collectors_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Fatal("expected new collectors for another registerer")
+	}
+
+	first.sessionResets.WithLabelValues("first", "fake", metricStatusSuccess).Inc()
+	other.sessionResets.WithLabelValues("other", "fake", metricStatusSuccess).Inc()
+
+	// Collector only collects the collectors of its registerer.
+	ch := make(chan prometheus.Metric)
+	go func() {
+		Collector(registry).Collect(ch)
+		close(ch)
+	}()
+
+	databases := make(map[string]bool)
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `"collectors_test_connection_session_resets_total"`) {
+			continue
+		}
+
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == labelDatabase {
+				databases[label.GetValue()] = true
+			}
+		}
+	}
+	if !databases["first"] || len(databases) != 1 {
+		t.Fatalf("got session resets of databases %v, want first", databases)
+	}
+
+	atomic.StoreInt32(&wrapped, 0)
+	if Wrapped() {
+		t.Fatal("expected Wrapped to return false before wrapping a driver")
+	}
+	_ = Wrap(fakeDriver{}, "test", WithRegisterer(prometheus.NewRegistry()))
+	if !Wrapped() {
+		t.Fatal("expected Wrapped to return true after wrapping a driver")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+const (
+	labelStatus   = "status"
+	labelDatabase = "database"
+	labelDriver   = "driver"
+	labelCall     = "call"
+
+	// Statuses for metrics (values of labelStatus).
+	metricStatusFail    = "fail"
+	metricStatusSuccess = "success"
+
+	// Driver calls measured by callsDuration (values of labelCall).
+	callBeginTx = "begin_tx"
+	callPing    = "ping"
+	callPrepare = "prepare"
+
+	metricConnectionOpenDuration = "connection_open_duration"
+	metricConnectionLifetime     = "connection_lifetime_seconds"
+	metricSessionResetsTotal     = "connection_session_resets_total"
+	metricDriverCallsDuration    = "driver_calls_duration"
+	metricConnectionWaitDuration = "connection_wait_duration"
+
+	helpConnectionOpenDuration = `Duration of opening (dialing) a new connection to the database in milliseconds`
+	helpConnectionLifetime     = `Time between opening and closing a connection to the database in seconds`
+	helpSessionResetsTotal     = `Sessions reset before a pooled connection was reused`
+	helpDriverCallsDuration    = `Duration of ping, prepare and begin transaction calls to the driver in milliseconds`
+	helpConnectionWaitDuration = `Time between requesting a connection for a statement and its first call to the driver in milliseconds`
+)
@@ -0,0 +1,71 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Opt is a function that operates on driverOpts, configuring one or more
+// parameters of a wrapped driver.
+type Opt func(o *driverOpts)
+
+type driverOpts struct {
+	prometheusNamespace  string
+	prometheusRegisterer prometheus.Registerer
+	driverName           string
+}
+
+// WithPrometheusNamespace sets a different namespace for the exported metrics.
+// The default namespace is "gormetrics", equal to the gormetrics plugin.
+func WithPrometheusNamespace(ns string) Opt {
+	return func(o *driverOpts) {
+		o.prometheusNamespace = ns
+	}
+}
+
+// WithRegisterer sets the Prometheus registerer the collectors are registered
+// with. The default registerer is prometheus.DefaultRegisterer, equal to the
+// gormetrics plugin.
+func WithRegisterer(r prometheus.Registerer) Opt {
+	return func(o *driverOpts) {
+		o.prometheusRegisterer = r
+	}
+}
+
+// WithDriverName sets the value of the driver label. By default, the name the
+// wrapped driver is registered with in database/sql is used, equal to the
+// gormetrics plugin.
+func WithDriverName(name string) Opt {
+	return func(o *driverOpts) {
+		o.driverName = name
+	}
+}
+
+// defaultDriverOpts creates a new driverOpts instance with the default values.
+func defaultDriverOpts() *driverOpts {
+	return &driverOpts{
+		prometheusNamespace:  "gormetrics",
+		prometheusRegisterer: prometheus.DefaultRegisterer,
+	}
+}
+
+// getOpts creates a driverOpts instance based on multiple user-defined options based
+// on the default options. See defaultDriverOpts for the default options.
+func getOpts(opts []Opt) *driverOpts {
+	c := defaultDriverOpts()
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type connectionRequestKey struct{}
+
+// wrapped is set to 1 once a driver or connector is wrapped.
+var wrapped int32
+
+// Wrapped returns true once a driver or connector was wrapped using Wrap or
+// WrapConnector. The gormetrics plugin only marks connection requests (see
+// WithConnectionRequest) if it returns true.
+func Wrapped() bool {
+	return atomic.LoadInt32(&wrapped) == 1
+}
+
+// connectionRequest marks the moment a connection was requested for a statement.
+type connectionRequest struct {
+	start time.Time
+
+	// observed is set to 1 once the wait time has been recorded.
+	observed int32
+}
+
+// WithConnectionRequest returns a copy of ctx which records that a connection is
+// requested from the database/sql pool at t, for a statement executed with the
+// returned context. The first call on a wrapped driver with this context
+// observes the time spent waiting for the pool in connection_wait_duration.
+// The gormetrics plugin does this for all statements.
+func WithConnectionRequest(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, connectionRequestKey{}, &connectionRequest{start: t})
+}
+
+// observeWait records the wait time of the connection request in ctx, if any
+// and not recorded before.
+func (o *observer) observeWait(ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+
+	request, ok := ctx.Value(connectionRequestKey{}).(*connectionRequest)
+	if !ok || !atomic.CompareAndSwapInt32(&request.observed, 0, 1) {
+		return
+	}
+
+	o.collectors.connectionWaitDuration.
+		WithLabelValues(o.database, o.driver).
+		Observe(milliseconds(request.start))
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConnectionWaitDuration(t *testing.T) {
+	c := WrapConnector(fakeConnector{driver: fakeDriver{context: true}}, "test",
+		WithRegisterer(prometheus.NewRegistry()), WithDriverName("fake"))
+	o := c.(*connector).observer
+
+	db := sql.OpenDB(c)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Hold the only connection, so the next statement waits for the pool.
+	held, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wait = 20 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		ctx := WithConnectionRequest(context.Background(), time.Now())
+		if err := db.PingContext(ctx); err != nil {
+			done <- err
+			return
+		}
+		// The wait time of a request is only observed once.
+		done <- db.PingContext(ctx)
+	}()
+
+	time.Sleep(wait)
+	if err := held.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var m dto.Metric
+	if err := o.collectors.connectionWaitDuration.WithLabelValues("test", "fake").(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	got := m.GetHistogram()
+	if got.GetSampleCount() != 1 {
+		t.Fatalf("got %d observed waits, want 1", got.GetSampleCount())
+	}
+	if min := float64(wait) / float64(time.Millisecond); got.GetSampleSum() < min {
+		t.Fatalf("got a wait of %vms, want at least %vms", got.GetSampleSum(), min)
+	}
+}
+
+func TestConnectionWaitDurationWithoutRequest(t *testing.T) {
+	o := newTestObserver(t)
+	c := newConn(&fakeContextConn{}, o)
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := observations(t, o.collectors.connectionWaitDuration, "test", "fake"); got != 0 {
+		t.Fatalf("got %d observed waits, want 0", got)
+	}
+}
@@ -15,54 +15,13 @@
 package gormetrics
 
 import (
-	"database/sql"
 	"database/sql/driver"
-	"reflect"
-	"sync"
-)
-
-type sqlDriverNames struct {
-	byType map[reflect.Type]string
-
-	sync.Mutex
-}
 
-// driverNames stores all mapped drivers by name.
-var driverNames = sqlDriverNames{
-	byType: make(map[reflect.Type]string),
-}
+	"github.com/survivorbat/gormetrics/internal/drivername"
+)
 
-// The database/sql API doesn't provide a way to get the registry name for
-// a driver from the driver type.
-// Adapted from https://github.com/golang/go/issues/12600#issuecomment-378363201.
+// sqlDriverToDriverName returns the name driver is registered with in
+// database/sql, which is used as the value of the driver label.
 func sqlDriverToDriverName(driver driver.Driver) string {
-	driverNames.Lock()
-	defer driverNames.Unlock()
-
-	driverType := reflect.TypeOf(driver)
-
-	if len(driverNames.byType) > 0 {
-		if driverName, found := driverNames.byType[driverType]; found {
-			return driverName
-		}
-	}
-
-	for _, driverName := range sql.Drivers() {
-		// We ignore this error because it will occur. We only need the
-		// driver connected to the name.
-		db, _ := sql.Open(driverName, "")
-
-		if db != nil {
-			driverType := reflect.TypeOf(db.Driver())
-			driverNames.byType[driverType] = driverName
-		}
-	}
-
-	if len(driverNames.byType) > 0 {
-		if driverName, found := driverNames.byType[driverType]; found {
-			return driverName
-		}
-	}
-
-	return ""
+	return drivername.Lookup(driver)
 }
@@ -18,6 +18,29 @@ package gormetrics
 // creating a gormetrics plugin instance with a nil plugin.
 const ErrDbIsNil gormetricsErr = "db is nil"
 
+// ErrAlreadyRegistered is the error returned by Register if gormetrics is
+// already registered on the callbacks of the database with the same plugin
+// scope, or with the same registerer and namespace, which would count every
+// statement twice.
+const ErrAlreadyRegistered gormetricsErr = "gormetrics is already registered on the callbacks of the database"
+
+// ErrSharedCallbacks is the error returned by Register if the callbacks of the
+// database are shared with a database registered under a different name or
+// instance, e.g. because both were opened with the same *gorm.Config. The
+// statements of both databases would be counted for both.
+const ErrSharedCallbacks gormetricsErr = "callbacks are shared with another database"
+
+// ErrDuplicateDatabase is the error returned by Register if a different
+// database is already registered with the same name and instance on the same
+// registerer and namespace, see WithMergedDatabase.
+const ErrDuplicateDatabase gormetricsErr = "database is already registered"
+
+// ErrInstanceMismatch is the error returned by Register if a database is
+// registered with an instance (see WithInstance) on the same registerer and
+// namespace as a database without one, or the other way around. Their metrics
+// would have different labels.
+const ErrInstanceMismatch gormetricsErr = "database is registered with and without an instance"
+
 // A simple type for constant errors. Makes errors easy to match.
 type gormetricsErr string
 
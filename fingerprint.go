@@ -0,0 +1,137 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// placeholderList matches a parenthesized list of placeholders, e.g. (?, ?, ?).
+	placeholderList = regexp.MustCompile(`\(\?(?:\s*,\s*\?)*\)`)
+
+	// placeholderRows matches repeated lists of placeholders, e.g. (?), (?).
+	placeholderRows = regexp.MustCompile(`\(\?\)(?:\s*,\s*\(\?\))+`)
+)
+
+// fingerprint normalizes sql so statements which only differ in their values
+// are considered equal. Literals and placeholders are replaced by ?, lists
+// of placeholders (IN lists, rows of a batch insert) are collapsed, comments
+// are dropped and whitespace is squashed. Quoted identifiers are kept as-is.
+func fingerprint(sql string) string {
+	return collapsePlaceholders(redact(sql))
+}
+
+// collapsePlaceholders collapses the lists of placeholders in redacted sql,
+// see fingerprint.
+func collapsePlaceholders(sql string) string {
+	sql = placeholderList.ReplaceAllString(sql, "(?)")
+	return placeholderRows.ReplaceAllString(sql, "(?)")
+}
+
+// redact replaces the literals and placeholders in sql by ?, drops comments
+// and squashes whitespace. Unlike fingerprint, lists are kept as-is.
+func redact(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	var last byte
+
+	write := func(c byte) {
+		b.WriteByte(c)
+		last = c
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'':
+			// String literal, '' is an escaped quote.
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+						continue
+					}
+					i++
+					break
+				}
+			}
+			write('?')
+
+		case c == '"' || c == '`':
+			// Quoted identifier, copied verbatim.
+			// An unterminated identifier runs up to the end of sql.
+			end := len(sql)
+			if n := strings.IndexByte(sql[i+1:], c); n != -1 {
+				end = i + n + 2
+			}
+			for _, q := range []byte(sql[i:end]) {
+				write(q)
+			}
+			i = end
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end == -1 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end == -1 {
+				i = len(sql)
+			} else {
+				i += end
+			}
+
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			// Numbered placeholder, e.g. $1 as used by PostgreSQL.
+			for i++; i < len(sql) && isDigit(sql[i]); i++ {
+			}
+			write('?')
+
+		case isDigit(c) && !isIdentifier(last):
+			for ; i < len(sql) && (isDigit(sql[i]) || sql[i] == '.'); i++ {
+			}
+			write('?')
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for ; i < len(sql) && (sql[i] == ' ' || sql[i] == '\t' || sql[i] == '\n' || sql[i] == '\r'); i++ {
+			}
+			if b.Len() > 0 && last != ' ' {
+				write(' ')
+			}
+
+		default:
+			write(c)
+			i++
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
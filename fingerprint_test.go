@@ -0,0 +1,66 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		sql, want string
+	}{
+		{
+			sql:  "SELECT * FROM `users` WHERE id = 1",
+			want: "SELECT * FROM `users` WHERE id = ?",
+		},
+		{
+			sql:  "SELECT * FROM \"orders\" WHERE \"orders\".\"user_id\" IN ($1,$2,$3)",
+			want: "SELECT * FROM \"orders\" WHERE \"orders\".\"user_id\" IN (?)",
+		},
+		{
+			sql:  "SELECT * FROM users WHERE name = 'O''Brien' AND deleted_at IS NULL",
+			want: "SELECT * FROM users WHERE name = ? AND deleted_at IS NULL",
+		},
+		{
+			sql:  "INSERT INTO `t1` (`a`,`b`) VALUES (?,?),(?,?),(?,?)",
+			want: "INSERT INTO `t1` (`a`,`b`) VALUES (?)",
+		},
+		{
+			sql:  "SELECT *\n\tFROM users /* app='x' */ LIMIT 10 -- trailing",
+			want: "SELECT * FROM users LIMIT ?",
+		},
+		{
+			sql:  "SELECT \"abc",
+			want: "SELECT \"abc",
+		},
+		{
+			sql:  "SELECT * FROM `users",
+			want: "SELECT * FROM `users",
+		},
+		{
+			sql:  "SELECT `",
+			want: "SELECT `",
+		},
+		{
+			sql:  "SELECT 'abc",
+			want: "SELECT ?",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := fingerprint(tc.sql); got != tc.want {
+			t.Fatalf("fingerprint(%q) = %q, want %q", tc.sql, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gormetricstest provides helpers to test the queries issued on a
+// *gorm.DB, e.g. by a repository, without scraping Prometheus.
+//
+//	func TestFindUser(t *testing.T) {
+//		db, _ := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+//		recorder := gormetricstest.New(t, db)
+//
+//		repository.FindUser(db, 1)
+//
+//		recorder.AssertQueries(t, gormetrics.OperationQuery, gormetricstest.StatusSuccess, 1)
+//	}
+package gormetricstest
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/survivorbat/gormetrics"
+	"gorm.io/gorm"
+)
+
+// DatabaseName is the name of the database gormetrics is registered with.
+const DatabaseName = "gormetricstest"
+
+// Status of a statement, used to filter the statements counted by the assertions.
+type Status string
+
+const (
+	StatusSuccess Status = "success"
+	StatusFail    Status = "fail"
+
+	// StatusAny matches both succeeded and failed statements.
+	StatusAny Status = ""
+)
+
+// Recorder counts the statements executed on a *gorm.DB since it was created or
+// last reset.
+type Recorder struct {
+	registration *gormetrics.Registration
+	registry     *prometheus.Registry
+	baseline     gormetrics.Snapshot
+}
+
+// New registers gormetrics on db against an isolated Prometheus registry, so
+// tests don't interfere with each other or the process-wide registry. gormetrics
+// is deregistered from db when the test finishes, so a shared db can be recorded
+// again by the next test. Warnings (e.g. about the pool settings of db) are
+// discarded. opts are passed to gormetrics.Register after the registerer and
+// logger, db must not be registered already.
+func New(t testing.TB, db *gorm.DB, opts ...gormetrics.RegisterOpt) *Recorder {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	opts = append([]gormetrics.RegisterOpt{gormetrics.WithRegisterer(registry), gormetrics.WithLogger(discardLogger{})}, opts...)
+
+	registration, err := gormetrics.NewRegistration(db, DatabaseName, opts...)
+	if err != nil {
+		t.Fatalf("gormetricstest: could not register gormetrics: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = registration.Deregister()
+	})
+
+	r := &Recorder{
+		registration: registration,
+		registry:     registry,
+	}
+	r.Reset()
+
+	return r
+}
+
+// discardLogger is a gormetrics.Logger that discards everything.
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// Registry returns the isolated registry the collectors are registered with,
+// e.g. to compare them using prometheus/testutil.
+func (r *Recorder) Registry() *prometheus.Registry {
+	return r.registry
+}
+
+// Reset forgets all statements executed so far.
+func (r *Recorder) Reset() {
+	r.baseline = r.registration.Snapshot()
+}
+
+// Queries returns the amount of statements of operation with status executed
+// since the recorder was created or last reset. An empty operation matches all
+// operations.
+func (r *Recorder) Queries(operation gormetrics.Operation, status Status) int {
+	current := r.registration.Snapshot()
+	return count(current, operation, status) - count(r.baseline, operation, status)
+}
+
+// AssertQueries fails t if the amount of statements of operation with status
+// executed since the recorder was created or last reset is not n. An empty
+// operation matches all operations.
+func (r *Recorder) AssertQueries(t testing.TB, operation gormetrics.Operation, status Status, n int) {
+	t.Helper()
+
+	if got := r.Queries(operation, status); got != n {
+		t.Errorf("gormetricstest: got %d %v statements, want %d", got, describe(operation, status), n)
+	}
+}
+
+// AssertNoQueriesDuring fails t if any statement is executed while fn runs, e.g.
+// to check that a cache prevents hitting the database.
+func (r *Recorder) AssertNoQueriesDuring(t testing.TB, fn func()) {
+	t.Helper()
+
+	before := r.registration.Snapshot()
+	fn()
+	after := r.registration.Snapshot()
+
+	if n := count(after, "", StatusAny) - count(before, "", StatusAny); n != 0 {
+		t.Errorf("gormetricstest: got %d statements, want none", n)
+	}
+}
+
+// count returns the amount of statements of operation with status in s.
+func count(s gormetrics.Snapshot, operation gormetrics.Operation, status Status) int {
+	o := s.All
+	if operation != "" {
+		o = s.Operations[operation]
+	}
+
+	switch status {
+	case StatusSuccess:
+		return int(o.Succeeded)
+	case StatusFail:
+		return int(o.Failed)
+	default:
+		return int(o.Total())
+	}
+}
+
+// describe describes the statements matched by operation and status.
+func describe(operation gormetrics.Operation, status Status) string {
+	description := "all"
+	if operation != "" {
+		description = string(operation)
+	}
+
+	if status != StatusAny {
+		description += " " + string(status)
+	}
+
+	return description
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetricstest
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/survivorbat/gormetrics"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type user struct {
+	ID   uint
+	Name string
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection opens a new in-memory database.
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(&user{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRecorder(t *testing.T) {
+	db := newTestDB(t)
+	recorder := New(t, db)
+
+	db.Create(&user{Name: "alice"})
+	db.Create(&user{Name: "bob"})
+
+	var users []user
+	db.Find(&users)
+
+	recorder.AssertQueries(t, gormetrics.OperationCreate, StatusSuccess, 2)
+	recorder.AssertQueries(t, gormetrics.OperationQuery, StatusAny, 1)
+	recorder.AssertQueries(t, "", StatusAny, 3)
+
+	recorder.Reset()
+	recorder.AssertQueries(t, "", StatusAny, 0)
+
+	db.Delete(&users[0])
+	recorder.AssertQueries(t, gormetrics.OperationDelete, StatusSuccess, 1)
+
+	db.Table("missing").Find(&users)
+	recorder.AssertQueries(t, gormetrics.OperationQuery, StatusFail, 1)
+
+	recorder.AssertNoQueriesDuring(t, func() {
+		_ = len(users)
+	})
+}
+
+func TestRecorderIsolated(t *testing.T) {
+	first := New(t, newTestDB(t))
+	second := newTestDB(t)
+	New(t, second)
+
+	second.Create(&user{Name: "alice"})
+
+	first.AssertQueries(t, "", StatusAny, 0)
+}
+
+func TestRecorderDiscardsWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// gormetrics warns about the unlimited amount of open connections.
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	New(t, db)
+
+	if buf.Len() != 0 {
+		t.Fatalf("got warnings logged to the default logger: %s", buf.String())
+	}
+}
+
+func TestAssertNoQueriesDuring(t *testing.T) {
+	db := newTestDB(t)
+	recorder := New(t, db)
+
+	fake := &fakeT{TB: t}
+	recorder.AssertNoQueriesDuring(fake, func() {
+		db.Create(&user{Name: "alice"})
+	})
+
+	if len(fake.errors) != 1 {
+		t.Fatalf("got failures %q, want a failure for the executed statement", fake.errors)
+	}
+}
+
+// fakeT records the failures reported by the assertions instead of failing
+// the test. Other methods are passed on to the embedded testing.TB.
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	gmdriver "github.com/survivorbat/gormetrics/driver"
+)
+
+// newRegistry creates a registry only containing the collectors of gormetrics
+// and wrapped drivers registered with registerer. It is served by Handler by
+// default.
+func newRegistry(registerer prometheus.Registerer) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(registererCollectors{registerer: registerer}, gmdriver.Collector(registerer))
+	return r
+}
+
+// registererCollectors collects the collectors of registerer in
+// collectors.all. It is an unchecked collector, since the set of collectors
+// grows as databases are registered.
+type registererCollectors struct {
+	registerer prometheus.Registerer
+}
+
+func (registererCollectors) Describe(chan<- *prometheus.Desc) {}
+
+func (r registererCollectors) Collect(ch chan<- prometheus.Metric) {
+	collectors.Lock()
+	all := make([]prometheus.Collector, len(collectors.all[r.registerer]))
+	copy(all, collectors.all[r.registerer])
+	collectors.Unlock()
+
+	for _, c := range all {
+		c.Collect(ch)
+	}
+}
+
+// HandlerOpt is a function that operates on handlerOpts, configuring one or
+// more parameters of the handler returned by Handler.
+type HandlerOpt func(o *handlerOpts)
+
+type handlerOpts struct {
+	registerer         prometheus.Registerer
+	gatherer           prometheus.Gatherer
+	disableCompression bool
+}
+
+// HandlerWithRegisterer serves the metrics of gormetrics and wrapped drivers
+// registered with r (see WithRegisterer) instead of
+// prometheus.DefaultRegisterer. Collectors of different registerers are never
+// served together, as databases with the same name would collide.
+func HandlerWithRegisterer(r prometheus.Registerer) HandlerOpt {
+	return func(o *handlerOpts) {
+		o.registerer = r
+	}
+}
+
+// HandlerWithGatherer sets the gatherer the handler serves metrics from. Use
+// prometheus.DefaultGatherer to serve the combined registry, containing the
+// gormetrics collectors (unless registered elsewhere, see WithRegisterer) and
+// all other collectors of the process.
+func HandlerWithGatherer(g prometheus.Gatherer) HandlerOpt {
+	return func(o *handlerOpts) {
+		o.gatherer = g
+	}
+}
+
+// HandlerWithoutCompression disables gzip compression of responses, even if
+// the client accepts it.
+func HandlerWithoutCompression() HandlerOpt {
+	return func(o *handlerOpts) {
+		o.disableCompression = true
+	}
+}
+
+// Handler returns an http.Handler serving metrics in the Prometheus exposition
+// format. By default, only the metrics of gormetrics and wrapped drivers (see
+// package driver) registered with prometheus.DefaultRegisterer are served, so
+// the handler can be mounted on any mux without owning the process-wide
+// /metrics endpoint:
+//
+//	mux.Handle("/metrics/database", gormetrics.Handler())
+//
+// The OpenMetrics format is served to clients asking for it, and responses are
+// gzipped if the client accepts it.
+func Handler(opts ...HandlerOpt) http.Handler {
+	o := handlerOpts{registerer: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.gatherer == nil {
+		o.gatherer = newRegistry(o.registerer)
+	}
+
+	return promhttp.HandlerFor(o.gatherer, promhttp.HandlerOpts{
+		ErrorHandling:      promhttp.ContinueOnError,
+		DisableCompression: o.disableCompression,
+		EnableOpenMetrics:  true,
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	qc, err := newQueryCounters(registry, "handler_test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc.all.With(prometheus.Labels{
+		labelStatus:   metricStatusSuccess,
+		labelDatabase: "db",
+		labelDriver:   "sqlite3",
+	}).Inc()
+
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+	}{
+		{
+			name:            "text format",
+			accept:          "",
+			wantContentType: "text/plain",
+		},
+		{
+			name:            "openmetrics",
+			accept:          "application/openmetrics-text; version=0.0.1",
+			wantContentType: "application/openmetrics-text",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			Handler(HandlerWithRegisterer(registry)).ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.wantContentType) {
+				t.Fatalf("got content type %q, want %q", got, tc.wantContentType)
+			}
+			body, _ := io.ReadAll(rec.Body)
+			if !strings.Contains(string(body), `handler_test_all_total{database="db",driver="sqlite3",status="success"} 1`) {
+				t.Fatalf("counter missing from response:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestHandlerRegisterers(t *testing.T) {
+	// Both registries contain the same series, which can't be served together.
+	registries := []*prometheus.Registry{prometheus.NewRegistry(), prometheus.NewRegistry()}
+	for i, registry := range registries {
+		r := registerTest(t, newTestDB(t), registry)
+		for j := 0; j <= i; j++ {
+			r.db.Find(&[]testUser{})
+		}
+	}
+
+	for i, registry := range registries {
+		if _, err := newRegistry(registry).Gather(); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		Handler(HandlerWithRegisterer(registry)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		body, _ := io.ReadAll(rec.Body)
+		want := fmt.Sprintf(`gormetrics_queries_total{database="test",driver="sqlite3",status="success"} %d`, i+1)
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("got response without %s:\n%s", want, body)
+		}
+		if got := strings.Count(string(body), "\ngormetrics_registered_databases "); got != 1 {
+			t.Fatalf("got %d registered databases gauges, want 1:\n%s", got, body)
+		}
+	}
+}
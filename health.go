@@ -0,0 +1,156 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrNotProbed is the error reported by the readiness check if the health probe
+// did not complete yet.
+const ErrNotProbed gormetricsErr = "database was not probed yet"
+
+// healthProbe periodically checks if the database is reachable, independently
+// of the queries performed by the application.
+type healthProbe struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	// query is executed instead of pinging the database if not empty.
+	query string
+
+	// lastErr is the result of the last probe, failures the amount of
+	// consecutive failed probes.
+	lastErr  error
+	failures int
+
+	sync.Mutex
+}
+
+// newHealthProbe creates a healthProbe based on opts, or returns nil if the
+// health probe is disabled.
+func newHealthProbe(opts *pluginOpts) *healthProbe {
+	if opts.healthProbeInterval <= 0 {
+		return nil
+	}
+
+	return &healthProbe{
+		interval: opts.healthProbeInterval,
+		timeout:  opts.healthProbeTimeout,
+		query:    opts.healthProbeQuery,
+		lastErr:  ErrNotProbed,
+	}
+}
+
+// probe checks the database once and exports the result, also to StatsD if enabled.
+func (p *healthProbe) probe(db *database, gauges *databaseGauges, statsd *statsdClient) {
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := db.ping(ctx, p.query)
+	elapsed := milliseconds(time.Since(start))
+
+	p.Lock()
+	p.lastErr = err
+	if err != nil {
+		p.failures++
+	} else {
+		p.failures = 0
+	}
+	failures := p.failures
+	p.Unlock()
+
+	defaultLabels := db.labels
+
+	status := metricStatusFail
+	up := 0.0
+	if err == nil {
+		status = metricStatusSuccess
+		up = 1
+	}
+
+	gauges.up.
+		With(defaultLabels).
+		Set(up)
+
+	gauges.pingFailures.
+		With(defaultLabels).
+		Set(float64(failures))
+
+	statusLabels := mergeLabels(prometheus.Labels{
+		labelStatus: status,
+	}, defaultLabels)
+
+	gauges.pingDuration.
+		With(statusLabels).
+		Observe(elapsed)
+
+	statsd.gauge(metricUp, up, defaultLabels)
+	statsd.gauge(metricPingFailures, float64(failures), defaultLabels)
+	statsd.timing(metricPingDuration, elapsed, statusLabels)
+}
+
+// err returns the result of the last probe.
+func (p *healthProbe) err() error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.lastErr
+}
+
+// readinessHandler reports if the database is reachable. If a health probe is
+// configured its last result is reported, otherwise the database is pinged.
+type readinessHandler struct {
+	db      *database
+	probe   *healthProbe
+	timeout time.Duration
+}
+
+// ServeHTTP responds with 200 if the database is reachable and with 503 otherwise.
+func (h readinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if h.probe != nil {
+		err = h.probe.err()
+	} else {
+		ctx := r.Context()
+		if h.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+		}
+		err = h.db.ping(ctx, "")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "database %v is not ready: %v\n", h.db.name, err)
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "database %v is ready\n", h.db.name)
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+
+		// probes is the amount of times the database is probed.
+		probes int
+
+		wantUp       float64
+		wantFailures float64
+		wantStatus   int
+	}{
+		{
+			name:       "ping",
+			probes:     1,
+			wantUp:     1,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "query",
+			query:      "SELECT 1",
+			probes:     1,
+			wantUp:     1,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:         "failing query",
+			query:        "SELECT * FROM missing",
+			probes:       2,
+			wantFailures: 2,
+			wantStatus:   http.StatusServiceUnavailable,
+		},
+		{
+			name:       "not probed",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := registerTest(t, newTestDB(t), prometheus.NewRegistry())
+			d := r.dbMetrics
+
+			probe := newHealthProbe(&pluginOpts{
+				healthProbeInterval: time.Hour,
+				healthProbeTimeout:  time.Second,
+				healthProbeQuery:    tc.query,
+			})
+			for i := 0; i < tc.probes; i++ {
+				probe.probe(d.db, d.gauges, nil)
+			}
+
+			if tc.probes > 0 {
+				if got := testutil.ToFloat64(d.gauges.up.With(d.db.labels)); got != tc.wantUp {
+					t.Fatalf("got up %v, want %v", got, tc.wantUp)
+				}
+				if got := testutil.ToFloat64(d.gauges.pingFailures.With(d.db.labels)); got != tc.wantFailures {
+					t.Fatalf("got %v consecutive failures, want %v", got, tc.wantFailures)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			readinessHandler{db: d.db, probe: probe}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestReadinessHandlerWithoutProbe(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry())
+	handler := r.ReadinessHandler(time.Second)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "database test is ready") {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusServiceUnavailable, rec.Body)
+	}
+}
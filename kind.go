@@ -0,0 +1,79 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// operationKinds contains the kinds of the operations with a kind label. The
+// first kind is the kind of a statement without special clauses.
+var operationKinds = map[Operation][]string{
+	OperationCreate: {kindPlain, kindUpsert},
+	OperationDelete: {kindHardDelete, kindSoftDelete},
+	OperationUpdate: {kindPlain},
+}
+
+// kindOf returns the kind of the statement in db, one of the kinds of
+// operation in operationKinds (or an empty kind for other operations):
+//
+//   - creates with an ON CONFLICT clause (e.g. clause.OnConflict) are upserts,
+//     other creates are plain
+//   - deletes of models with a soft delete field (e.g. gorm.DeletedAt) are soft
+//     deletes, unless they're unscoped; other deletes are hard deletes
+//   - updates are plain
+func kindOf(db *gorm.DB, operation Operation) string {
+	stmt := db.Statement
+
+	switch operation {
+	case OperationCreate:
+		if _, upsert := stmt.Clauses["ON CONFLICT"]; upsert {
+			return kindUpsert
+		}
+		return kindPlain
+	case OperationDelete:
+		if !stmt.Unscoped && stmt.Schema != nil && len(stmt.Schema.DeleteClauses) > 0 {
+			return kindSoftDelete
+		}
+		return kindHardDelete
+	case OperationUpdate:
+		return kindPlain
+	}
+
+	return ""
+}
+
+// kindObservers contains the operationObservers of an operation by kind.
+type kindObservers map[string]*operationObservers
+
+// newKindObservers resolves the series of the vectors of an operation with
+// labels for every kind in kinds and every status. The series are initialized
+// at 0.
+func newKindObservers(
+	total *prometheus.CounterVec,
+	duration *prometheus.HistogramVec,
+	executionDuration *prometheus.HistogramVec,
+	labels prometheus.Labels,
+	kinds []string,
+) kindObservers {
+	observers := make(kindObservers, len(kinds))
+	for _, kind := range kinds {
+		l := mergeLabels(prometheus.Labels{labelKind: kind}, labels)
+		observers[kind] = newOperationObservers(total, duration, executionDuration, l)
+	}
+
+	return observers
+}
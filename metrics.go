@@ -18,6 +18,21 @@ const (
 	labelStatus   = "status"
 	labelDatabase = "database"
 	labelDriver   = "driver"
+	labelTable    = "table"
+	labelInstance = "instance"
+	labelMetric   = "metric"
+	labelLabel    = "label"
+	labelModel    = "model"
+
+	labelOrigin      = "origin"
+	labelAssociation = "association"
+	labelKind        = "kind"
+
+	// Kinds of statements (values of labelKind).
+	kindPlain      = "plain"
+	kindUpsert     = "upsert"
+	kindSoftDelete = "soft_delete"
+	kindHardDelete = "hard_delete"
 
 	// Statuses for metrics (values of labelStatus).
 	metricStatusFail    = "fail"
@@ -31,25 +46,77 @@ const (
 	helpIdleConnections  = `Currently idle connections to the database`
 	helpInUseConnections = `Currently in use connections`
 
-	metricAllTotal        = "all_total"
-	metricAllDuration     = "all_duration"
-	metricCreatesTotal    = "creates_total"
-	metricCreatesDuration = "creates_duration"
-	metricDeletesTotal    = "deletes_total"
-	metricDeletesDuration = "deletes_duration"
-	metricQueriesTotal    = "queries_total"
-	metricQueriesDuration = "queries_duration"
-	metricUpdatesTotal    = "updates_total"
-	metricUpdatesDuration = "updates_duration"
-
-	helpAllTotal        = `All queries requested`
-	helpAllDuration     = `Duration of all queries requested in milliseconds`
-	helpCreatesTotal    = `All create queries requested`
-	helpCreatesDuration = `Duration of all create queries requested in milliseconds`
-	helpDeletesTotal    = `All delete queries requested`
-	helpDeletesDuration = `Duration of all delete queries requested in milliseconds`
-	helpQueriesTotal    = `All select queries requested`
-	helpQueriesDuration = `Duration of all select queries requested in milliseconds`
-	helpUpdatesTotal    = `All update queries requested`
-	helpUpdatesDuration = `Duration of all update queries requested in milliseconds`
+	metricMaxOpenConnections    = "connections_max_open"
+	metricMaxIdleConnections    = "connections_max_idle"
+	metricConnectionMaxLifetime = "connections_max_lifetime_seconds"
+	metricConnectionMaxIdleTime = "connections_max_idle_time_seconds"
+
+	helpMaxOpenConnections    = `Maximum amount of open connections to the database, 0 is unlimited`
+	helpMaxIdleConnections    = `Maximum amount of idle connections to the database, as declared`
+	helpConnectionMaxLifetime = `Maximum time a connection may be reused in seconds, as declared, 0 is unlimited`
+	helpConnectionMaxIdleTime = `Maximum time a connection may be idle in seconds, as declared, 0 is unlimited`
+
+	metricUp           = "up"
+	metricPingDuration = "ping_duration"
+	metricPingFailures = "ping_consecutive_failures"
+
+	helpUp           = `Whether the last health probe of the database succeeded (1) or not (0)`
+	helpPingDuration = `Duration of health probes of the database in milliseconds`
+	helpPingFailures = `Amount of consecutive failed health probes of the database`
+
+	metricAllTotal                 = "all_total"
+	metricAllDuration              = "all_duration"
+	metricAllExecutionDuration     = "all_execution_duration"
+	metricCreatesTotal             = "creates_total"
+	metricCreatesDuration          = "creates_duration"
+	metricCreatesExecutionDuration = "creates_execution_duration"
+	metricDeletesTotal             = "deletes_total"
+	metricDeletesDuration          = "deletes_duration"
+	metricDeletesExecutionDuration = "deletes_execution_duration"
+	metricQueriesTotal             = "queries_total"
+	metricQueriesDuration          = "queries_duration"
+	metricQueriesExecutionDuration = "queries_execution_duration"
+	metricUpdatesTotal             = "updates_total"
+	metricUpdatesDuration          = "updates_duration"
+	metricUpdatesExecutionDuration = "updates_execution_duration"
+
+	helpAllTotal                 = `All queries requested`
+	helpAllDuration              = `Duration of all queries requested, including hooks and associations, in milliseconds`
+	helpAllExecutionDuration     = `Duration of all queries executed by the database driver in milliseconds`
+	helpCreatesTotal             = `All create queries requested`
+	helpCreatesDuration          = `Duration of all create queries requested, including hooks and associations, in milliseconds`
+	helpCreatesExecutionDuration = `Duration of all create queries executed by the database driver in milliseconds`
+	helpDeletesTotal             = `All delete queries requested`
+	helpDeletesDuration          = `Duration of all delete queries requested, including hooks and associations, in milliseconds`
+	helpDeletesExecutionDuration = `Duration of all delete queries executed by the database driver in milliseconds`
+	helpQueriesTotal             = `All select queries requested`
+	helpQueriesDuration          = `Duration of all select queries requested, including hooks and preloads, in milliseconds`
+	helpQueriesExecutionDuration = `Duration of all select queries executed by the database driver in milliseconds`
+	helpUpdatesTotal             = `All update queries requested`
+	helpUpdatesDuration          = `Duration of all update queries requested, including hooks and associations, in milliseconds`
+	helpUpdatesExecutionDuration = `Duration of all update queries executed by the database driver in milliseconds`
+
+	metricAssociationStatementsTotal    = "association_statements_total"
+	metricAssociationStatementsDuration = "association_statements_duration"
+
+	helpAssociationStatementsTotal    = `Statements executed to preload or save the associations of another statement`
+	helpAssociationStatementsDuration = `Duration of statements executed to preload or save the associations of another statement in milliseconds`
+
+	metricBatchesTotal = "batches_total"
+	metricBatchSize    = "batch_size"
+
+	helpBatchesTotal = `INSERT statements inserting a slice of records, e.g. every batch of CreateInBatches`
+	helpBatchSize    = `Rows inserted per INSERT statement`
+
+	metricRegisteredDatabases = "registered_databases"
+
+	helpRegisteredDatabases = `Databases gormetrics is registered on that haven't been deregistered or expired`
+
+	metricDroppedLabelValues = "dropped_label_values_total"
+
+	helpDroppedLabelValues = `Label values replaced by ` + overflowValue + ` because a cardinality limit was reached`
+
+	metricNPlusOneDetected = "n_plus_one_detected_total"
+
+	helpNPlusOneDetected = `Statements executed more often than the N+1 threshold within a single request`
 )
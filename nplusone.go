@@ -0,0 +1,125 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// NPlusOne describes a statement that was executed more often than the
+// configured threshold within a single request scope.
+type NPlusOne struct {
+	// Database is the name of the database the statements were executed on.
+	Database string
+
+	// Table is the table the statements operated on.
+	Table string
+
+	// Fingerprint is the normalized SQL of the statements, without values.
+	Fingerprint string
+
+	// Count is the amount of times the fingerprint was executed when the
+	// threshold was exceeded.
+	Count int
+}
+
+// NPlusOneReporter is called by the N+1 query detector when a statement
+// fingerprint exceeds the threshold within a request scope. ctx is the
+// context of the statement that exceeded the threshold.
+type NPlusOneReporter func(ctx context.Context, detection NPlusOne)
+
+type requestScopeKey struct{}
+
+// requestScope counts the statements executed within a single request.
+type requestScope struct {
+	counts map[requestScopeStatement]int
+
+	sync.Mutex
+}
+
+type requestScopeStatement struct {
+	database    string
+	fingerprint string
+}
+
+// WithRequestScope returns a copy of ctx that marks the start of a request.
+// When the N+1 query detector is enabled (see WithNPlusOneDetector), all
+// statements executed with this context (e.g. using db.WithContext(ctx)) are
+// grouped and checked for repetition. Statements without a request scope are
+// ignored by the detector.
+func WithRequestScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestScopeKey{}, &requestScope{
+		counts: make(map[requestScopeStatement]int),
+	})
+}
+
+// nPlusOneDetector flags statements which are executed more than threshold
+// times within a request scope.
+type nPlusOneDetector struct {
+	threshold int
+	report    NPlusOneReporter
+	detected  *prometheus.CounterVec
+	statsd    *statsdClient
+
+	// limiter is nil if the cardinality limits are disabled.
+	limiter *cardinalityLimiter
+}
+
+// check registers the statement in db with the request scope in its context and
+// reports it if the statement exceeded the threshold. Every fingerprint is
+// reported at most once per request scope.
+func (d *nPlusOneDetector) check(db *gorm.DB, labels prometheus.Labels) {
+	if db.Statement.Context == nil || db.Statement.SQL.Len() == 0 {
+		return
+	}
+
+	scope, ok := db.Statement.Context.Value(requestScopeKey{}).(*requestScope)
+	if !ok {
+		return
+	}
+
+	statement := requestScopeStatement{
+		database:    labels[labelDatabase],
+		fingerprint: fingerprint(db.Statement.SQL.String()),
+	}
+
+	scope.Lock()
+	scope.counts[statement]++
+	count := scope.counts[statement]
+	scope.Unlock()
+
+	if count != d.threshold+1 {
+		return
+	}
+
+	tableLabels := d.limiter.limit(metricNPlusOneDetected, mergeLabels(prometheus.Labels{
+		labelTable: db.Statement.Table,
+	}, labels))
+	d.detected.With(tableLabels).Add(1)
+	d.statsd.count(metricNPlusOneDetected, 1, tableLabels)
+
+	if d.report != nil {
+		d.report(db.Statement.Context, NPlusOne{
+			Database:    statement.database,
+			Table:       db.Statement.Table,
+			Fingerprint: statement.fingerprint,
+			Count:       count,
+		})
+	}
+}
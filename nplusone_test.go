@@ -0,0 +1,81 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNPlusOneDetector(t *testing.T) {
+	db := newTestDB(t)
+
+	var detections []NPlusOne
+	r := registerTest(t, db, prometheus.NewRegistry(), WithNPlusOneDetector(2, func(_ context.Context, n NPlusOne) {
+		detections = append(detections, n)
+	}))
+
+	// Statements without a request scope are ignored.
+	for i := 0; i < 5; i++ {
+		db.First(&testUser{}, i)
+	}
+	if len(detections) != 0 {
+		t.Fatalf("got detections %+v without a request scope, want none", detections)
+	}
+
+	for i, scope := range []context.Context{WithRequestScope(context.Background()), WithRequestScope(context.Background())} {
+		// Up to the threshold isn't reported.
+		for j := 0; j < 2; j++ {
+			db.WithContext(scope).First(&testUser{}, j)
+		}
+		db.WithContext(scope).Find(&[]testUser{})
+		if len(detections) != i {
+			t.Fatalf("got detections %+v at the threshold, want %d", detections, i)
+		}
+
+		// Every fingerprint is reported once per scope.
+		for j := 0; j < 5; j++ {
+			db.WithContext(scope).First(&testUser{}, j)
+		}
+	}
+
+	if len(detections) != 2 {
+		t.Fatalf("got %d detections, want one per scope", len(detections))
+	}
+	want := NPlusOne{
+		Database:    "test",
+		Table:       "test_users",
+		Fingerprint: "SELECT * FROM `test_users` WHERE `test_users`.`id` = ? ORDER BY `test_users`.`id` LIMIT ?",
+		Count:       3,
+	}
+	for _, got := range detections {
+		if got != want {
+			t.Fatalf("got detection %+v, want %+v", got, want)
+		}
+	}
+
+	expected := `
+		# HELP gormetrics_n_plus_one_detected_total ` + helpNPlusOneDetected + `
+		# TYPE gormetrics_n_plus_one_detected_total counter
+		gormetrics_n_plus_one_detected_total{database="test",driver="sqlite3",table="test_users"} 2
+	`
+	if err := testutil.CollectAndCompare(r.handler.nPlusOne.detected, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,6 +14,14 @@
 
 package gormetrics
 
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
 const (
 	// DisableGormMetricsDatabaseKey can be set on the *gorm.DB object to (temporarily) disable metrics on a particular query
 	DisableGormMetricsDatabaseKey = "gormmetrics-enabled"
@@ -24,8 +32,43 @@ const (
 type RegisterOpt func(o *pluginOpts)
 
 type pluginOpts struct {
-	prometheusNamespace string
-	gormPluginScope     string
+	prometheusNamespace  string
+	prometheusRegisterer prometheus.Registerer
+	gormPluginScope      string
+
+	instance       string
+	mergeDatabases bool
+	idleTTL        time.Duration
+	modelLabel     bool
+
+	// Cardinality limits of dynamic labels, 0 is unlimited.
+	cardinalityMaxValues int
+	cardinalityMaxSeries int
+
+	nPlusOneThreshold int
+	nPlusOneReporter  NPlusOneReporter
+
+	// sqlCommenter is nil if SQL comments are disabled.
+	sqlCommenter *sqlCommenter
+
+	// poolSettings is nil if no pool settings were declared.
+	poolSettings *PoolSettings
+	logger       Logger
+
+	healthProbeInterval time.Duration
+	healthProbeTimeout  time.Duration
+	healthProbeQuery    string
+
+	statementLogRecent  int
+	statementLogSlowest int
+
+	pushgatewayURL      string
+	pushgatewayJob      string
+	pushgatewayInterval time.Duration
+	pushgatewayClient   push.HTTPDoer
+
+	// statsd is nil if the StatsD backend is disabled.
+	statsd *statsdConfig
 }
 
 // WithPrometheusNamespace sets a different namespace for the exported metrics.
@@ -36,6 +79,16 @@ func WithPrometheusNamespace(ns string) RegisterOpt {
 	}
 }
 
+// WithRegisterer sets the Prometheus registerer the collectors are registered
+// with. The default registerer is prometheus.DefaultRegisterer. Use a separate
+// registry (e.g. prometheus.NewRegistry()) to keep gormetrics out of the
+// process-wide registry, and serve it using Handler and HandlerWithRegisterer.
+func WithRegisterer(r prometheus.Registerer) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.prometheusRegisterer = r
+	}
+}
+
 // WithGORMPluginScope sets a different plugin scope for the configured callbacks.
 // The default plugin scope is "gormetrics".
 func WithGORMPluginScope(s string) RegisterOpt {
@@ -44,11 +97,190 @@ func WithGORMPluginScope(s string) RegisterOpt {
 	}
 }
 
+// WithInstance adds an instance label with value name to all metrics, so
+// databases registered with the same name (e.g. the shards or tenants of one
+// logical database) are exported as separate series. All databases registered
+// with the same registerer and namespace must either set an instance or not,
+// otherwise Register returns ErrInstanceMismatch.
+func WithInstance(name string) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.instance = name
+	}
+}
+
+// WithMergedDatabase allows registering a database with the same name (and
+// instance) as a database that is already registered on the same registerer
+// and namespace, merging their series. Without it, Register returns
+// ErrDuplicateDatabase. The pool gauges of merged databases overwrite each
+// other, use WithInstance to keep them apart.
+func WithMergedDatabase() RegisterOpt {
+	return func(o *pluginOpts) {
+		o.mergeDatabases = true
+	}
+}
+
+// WithIdleTTL deletes the query series and connection statistics of the
+// database once no statements have been executed on it for ttl, checked every
+// half ttl (but at most every 100ms). They're exported again on the next
+// statement. The series of merged databases (see
+// WithMergedDatabase) are kept. Use Registration.Deregister to delete the
+// series of a database that's no longer used at all.
+func WithIdleTTL(ttl time.Duration) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.idleTTL = ttl
+	}
+}
+
+// WithModelLabel adds a model label to the query metrics, containing the name
+// of the model of the statement (e.g. User). Statements without a model, such
+// as raw SQL, have an empty model. All databases registered with the same
+// registerer and namespace must either enable or disable the model label.
+func WithModelLabel() RegisterOpt {
+	return func(o *pluginOpts) {
+		o.modelLabel = true
+	}
+}
+
+// WithCardinalityLimit limits the distinct values of every dynamic label (such
+// as table) of a metric to values, and the distinct series of a metric to
+// series, per database. Values exceeding a limit are replaced by __overflow__
+// and counted in gormetrics_dropped_label_values_total. The labels identifying
+// the database and the status are never limited. 0 disables a limit. The
+// defaults are 1000 values and 10000 series.
+func WithCardinalityLimit(values, series int) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.cardinalityMaxValues = values
+		o.cardinalityMaxSeries = series
+	}
+}
+
+// WithNPlusOneDetector enables the N+1 query detector. Statements executed with a
+// context created by WithRequestScope are grouped by their normalized SQL; when
+// the same statement runs more than threshold times within one request scope,
+// gormetrics_n_plus_one_detected_total is incremented and report (if not nil)
+// is called with the offending fingerprint.
+func WithNPlusOneDetector(threshold int, report NPlusOneReporter) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.nPlusOneThreshold = threshold
+		o.nPlusOneReporter = report
+	}
+}
+
+// WithSQLCommenter appends a sqlcommenter (https://google.github.io/sqlcommenter/)
+// formatted comment to every statement before it's executed, so statements can
+// be traced back to the application in e.g. pg_stat_statements or slow query logs.
+// The comment contains the database name used in the metrics, the location of the
+// application code that issued the statement and the route set with WithRoute.
+// See the SQLComment options for the other values that can be added. If GORM
+// prepares statements (see gorm.Config.PrepareStmt), the location, route and
+// traceparent are left out, as every distinct comment would be prepared and
+// cached as a separate statement.
+func WithSQLCommenter(opts ...SQLCommentOpt) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.sqlCommenter = defaultSQLCommenter()
+		for _, opt := range opts {
+			opt(o.sqlCommenter)
+		}
+	}
+}
+
+// WithPoolSettings applies the pool settings to the *sql.DB backing GORM when
+// registering, so they are exported and checked for dangerous values.
+// database/sql doesn't expose them, so they must not be changed on the *sql.DB
+// afterwards. Set the maximum amount of open connections before registering.
+func WithPoolSettings(s PoolSettings) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.poolSettings = &s
+	}
+}
+
+// WithLogger sets the logger gormetrics uses to warn about problems, such as
+// dangerous pool settings. The default logger is log.Default().
+func WithLogger(l Logger) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.logger = l
+	}
+}
+
+// WithHealthProbe enables the health probe, which pings the database every
+// interval, independently of the queries performed by the application. A probe
+// fails if it takes longer than timeout. The results are exported as the up,
+// ping_duration and ping_consecutive_failures metrics and reported by
+// Registration.ReadinessHandler.
+func WithHealthProbe(interval, timeout time.Duration) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.healthProbeInterval = interval
+		o.healthProbeTimeout = timeout
+	}
+}
+
+// WithHealthProbeQuery makes the health probe execute query (e.g. SELECT 1)
+// instead of pinging the database. Only has effect if the health probe is enabled
+// using WithHealthProbe.
+func WithHealthProbeQuery(query string) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.healthProbeQuery = query
+	}
+}
+
+// WithStatementLog enables the statement log, which keeps the last recent
+// statements and the slowest statements (up to slowest per fingerprint, for
+// up to 100 fingerprints) in memory. The log is served by
+// Registration.StatementLogHandler. Values of statements are never recorded,
+// nor are the messages of errors, which may contain them.
+func WithStatementLog(recent, slowest int) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.statementLogRecent = recent
+		o.statementLogSlowest = slowest
+	}
+}
+
+// WithPushgateway pushes the metrics of the database to the Pushgateway at url
+// every interval and when Registration.Close is called, for batch jobs and CLIs
+// that exit before they are scraped. An interval of 0 only pushes on Close.
+// The job, the name and the instance (see WithInstance) of the database form
+// the grouping key, so databases registered by the same job don't overwrite
+// each other.
+func WithPushgateway(url, job string, interval time.Duration) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.pushgatewayURL = url
+		o.pushgatewayJob = job
+		o.pushgatewayInterval = interval
+	}
+}
+
+// WithPushgatewayClient sets the HTTP client used to push metrics, e.g. to
+// configure authentication or TLS. Only has effect if pushing is enabled using
+// WithPushgateway. The default client is http.DefaultClient.
+func WithPushgatewayClient(c push.HTTPDoer) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.pushgatewayClient = c
+	}
+}
+
+// WithStatsD sends the query metrics, connection gauges and health probe results
+// to the StatsD server at addr (host:port) over UDP, in addition to exporting them
+// to Prometheus. Labels are sent as DogStatsD tags by default, see the StatsD
+// options to configure plain StatsD names, sampling and batching. Metric names
+// are prefixed with the Prometheus namespace and a dot.
+func WithStatsD(addr string, opts ...StatsDOpt) RegisterOpt {
+	return func(o *pluginOpts) {
+		o.statsd = defaultStatsDConfig(addr)
+		for _, opt := range opts {
+			opt(o.statsd)
+		}
+	}
+}
+
 // defaultPluginOpts creates a new pluginOpts instance with the default values.
 func defaultPluginOpts() *pluginOpts {
 	return &pluginOpts{
-		prometheusNamespace: "gormetrics",
-		gormPluginScope:     "gormetrics",
+		prometheusNamespace:  "gormetrics",
+		prometheusRegisterer: prometheus.DefaultRegisterer,
+		gormPluginScope:      "gormetrics",
+		cardinalityMaxValues: 1000,
+		cardinalityMaxSeries: 10000,
+		logger:               log.Default(),
 	}
 }
 
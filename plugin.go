@@ -15,14 +15,161 @@
 package gormetrics
 
 import (
+	"net/http"
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
 
+// Registration is the handle of gormetrics registered on a database, returned
+// by NewRegistration.
+type Registration struct {
+	db        *gorm.DB
+	info      extraInfo
+	opts      *pluginOpts
+	handler   *callbackHandler
+	dbMetrics *databaseMetrics
+
+	// pusher is nil if pushing to a Pushgateway is disabled.
+	pusher *pusher
+
+	// statsd is nil if the StatsD backend is disabled.
+	statsd *statsdClient
+
+	// expiry is nil if the idle TTL is disabled.
+	expiry *idleExpiry
+
+	registration *registration
+
+	// queryCollectors contains the collectors registered using
+	// RegisterQueryCollector, guarded by collectors.
+	queryCollectors []prometheus.Collector
+}
+
+// ReadinessHandler returns an http.Handler reporting if the database is reachable,
+// which can be used as a readiness check. It responds with 200 if the database
+// is reachable and with 503 otherwise. If the health probe is enabled (see
+// WithHealthProbe) its last result is reported, otherwise the database is pinged
+// on every request, failing if that takes longer than timeout (0 means no timeout).
+func (r *Registration) ReadinessHandler(timeout time.Duration) http.Handler {
+	return r.dbMetrics.readinessHandler(timeout)
+}
+
+// StatementLogHandler returns an http.Handler serving the recent and slowest
+// statements recorded by the statement log (see WithStatementLog) as HTML, or
+// as JSON if requested using ?format=json or the Accept header. It responds
+// with 404 if the statement log is disabled.
+func (r *Registration) StatementLogHandler() http.Handler {
+	return statementLogHandler{log: r.handler.statementLog}
+}
+
+// Snapshot returns the current values of the query metrics and the pool
+// statistics of the database, e.g. to assert on them in tests. Queries on other
+// databases are not included, even if they share the same collectors.
+func (r *Registration) Snapshot() Snapshot {
+	return newSnapshot(r.info, r.handler.counters, r.dbMetrics.db)
+}
+
+// PublishExpvar publishes the snapshot of the database (see Snapshot) in expvar
+// under name, so it is served by /debug/vars. ErrExpvarPublished is returned if
+// a variable with the same name already exists.
+func (r *Registration) PublishExpvar(name string) error {
+	return publishExpvar(name, r.Snapshot)
+}
+
+// RegisterQueryCollector registers gauges that are collected by executing the
+// SQL in c through the database at scrape time. The queries are excluded from
+// the query metrics. The gauges have constant database and driver labels.
+func (r *Registration) RegisterQueryCollector(c QueryCollector) error {
+	collector, err := newQueryCollector(c, r.db, r.info, r.opts)
+	if err != nil {
+		return err
+	}
+
+	collectors.Lock()
+	defer collectors.Unlock()
+
+	if err := registerCollectors(r.opts.prometheusRegisterer, collector); err != nil {
+		return errors.Wrapf(err, "could not register query collector %v", c.Name)
+	}
+	r.queryCollectors = append(r.queryCollectors, collector)
+
+	return nil
+}
+
+// Close stops collecting connection statistics and probing the database in the
+// background. Queries keep being measured, but are no longer sent to StatsD (see
+// WithStatsD). If pushing is enabled (see WithPushgateway), the metrics are
+// pushed a final time.
+func (r *Registration) Close() error {
+	r.expiry.stop()
+	r.dbMetrics.stop()
+
+	var err error
+	if r.pusher != nil {
+		r.dbMetrics.db.collectConnectionStats(r.dbMetrics.gauges, nil)
+		err = r.pusher.stop()
+	}
+
+	if closeErr := r.statsd.close(); err == nil {
+		err = errors.Wrap(closeErr, "could not close StatsD connection")
+	}
+
+	return err
+}
+
+// Deregister removes gormetrics from the database: its callbacks are removed,
+// the registration is closed (see Close) and the series of the database and
+// its query collectors are deleted, unless another database is merged with it
+// (see WithMergedDatabase). If it was the last database registered with its
+// registerer and namespace, the collectors are unregistered from the
+// registerer. The database can be registered again afterwards.
+func (r *Registration) Deregister() error {
+	if err := r.handler.removeCallbacks(r.db); err != nil {
+		return err
+	}
+
+	err := r.Close()
+	merged := registeredDatabases.remove(r.registration)
+
+	collectors.Lock()
+	unregisterCollectors(r.opts.prometheusRegisterer, r.queryCollectors...)
+	r.queryCollectors = nil
+	collectors.Unlock()
+
+	if !merged {
+		labels := r.info.labels()
+		deleteSeries(labels, r.handler.counters.collectors()...)
+		deleteSeries(labels, r.dbMetrics.gauges.collectors()...)
+	}
+
+	if !registeredDatabases.uses(r.opts.prometheusRegisterer, r.opts.prometheusNamespace) {
+		releaseCollectors(r.opts.prometheusRegisterer, r.opts.prometheusNamespace)
+	}
+
+	return err
+}
+
+// expire deletes the series of the database after it has been idle for longer
+// than the idle TTL, see WithIdleTTL. Like Deregister, the series are kept if
+// another database is merged with it, since they are shared.
+func (r *Registration) expire() {
+	if registeredDatabases.merged(r.registration) {
+		return
+	}
+
+	r.handler.expire()
+	r.dbMetrics.expire()
+}
+
 // Register gormetrics. Options (opts) can be used to configure the Prometheus
-// namespace and GORM plugin scope.
+// namespace and GORM plugin scope. Registering gormetrics twice on the same
+// callbacks, or registering two databases with the same name, returns an error
+// (see ErrAlreadyRegistered, ErrSharedCallbacks and ErrDuplicateDatabase).
+// Use NewRegistration to get a handle to close or deregister gormetrics.
 func Register(db *gorm.DB, dbName string, opts ...RegisterOpt) error {
 	if db == nil {
 		return ErrDbIsNil
@@ -36,30 +183,109 @@ func Register(db *gorm.DB, dbName string, opts ...RegisterOpt) error {
 // Options (opts) can be used to configure the Prometheus namespace and
 // GORM plugin scope.
 func RegisterInterface(db *gorm.DB, dbName string, opts ...RegisterOpt) error {
+	_, err := NewRegistration(db, dbName, opts...)
+	return err
+}
+
+// NewRegistration registers gormetrics like Register, and returns the
+// Registration of gormetrics on the database, which can be used to close or
+// deregister it and exposes its handlers and snapshot.
+func NewRegistration(db *gorm.DB, dbName string, opts ...RegisterOpt) (*Registration, error) {
 	if v := reflect.ValueOf(db); v.Kind() == reflect.Ptr && v.IsNil() {
-		return ErrDbIsNil
+		return nil, ErrDbIsNil
 	}
 
 	sql, err := db.DB()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get database")
+	}
+
 	driverName := sqlDriverToDriverName(sql.Driver())
 	handlerOpts := getOpts(opts)
 	info := extraInfo{
 		dbName:     dbName,
 		driverName: driverName,
+		instance:   handlerOpts.instance,
 	}
 
-	handler, err := newCallbackHandler(info, handlerOpts)
+	expiry := newIdleExpiry(handlerOpts.idleTTL)
+	registration := &registration{
+		callbacks:  db.Callback(),
+		scope:      handlerOpts.gormPluginScope,
+		registerer: handlerOpts.prometheusRegisterer,
+		namespace:  handlerOpts.prometheusNamespace,
+		dbName:     dbName,
+		instance:   handlerOpts.instance,
+		expiry:     expiry,
+	}
+
+	// Conflicts are checked before creating the collectors, as conflicting
+	// label names would fail with a less helpful Prometheus error.
+	if err := registeredDatabases.check(registration, handlerOpts.mergeDatabases); err != nil {
+		return nil, errors.Wrapf(err, "could not register database %v", dbName)
+	}
+
+	statsd, err := newStatsDClient(handlerOpts)
 	if err != nil {
-		return errors.Wrap(err, "could not create callback handler")
+		return nil, err
 	}
-	handler.registerCallback(db)
 
-	dbInterface := newDatabase(info, sql)
-	dbMetrics, err := newDatabaseMetrics(dbInterface, handlerOpts)
+	if err := newRegisteredDatabasesGauge(handlerOpts.prometheusRegisterer, handlerOpts.prometheusNamespace); err != nil {
+		statsd.close()
+		return nil, errors.Wrap(err, "could not create registered databases gauge")
+	}
+
+	// Everything that can fail is set up before the database is registered and
+	// the callbacks are added, so a failed registration can be retried.
+	handler, err := newCallbackHandler(info, handlerOpts, statsd, expiry)
+	if err != nil {
+		statsd.close()
+		return nil, errors.Wrap(err, "could not create callback handler")
+	}
+
+	dbInterface := newDatabase(info, sql, handlerOpts.poolSettings)
+	dbMetrics, err := newDatabaseMetrics(dbInterface, handlerOpts, statsd, expiry)
 	if err != nil {
-		return errors.Wrap(err, "could not create database metrics exporter")
+		statsd.close()
+		return nil, errors.Wrap(err, "could not create database metrics exporter")
+	}
+	pusher, err := newPusher(info, handlerOpts, append(handler.counters.collectors(), dbMetrics.gauges.collectors()...)...)
+	if err != nil {
+		statsd.close()
+		return nil, errors.Wrap(err, "could not create pusher")
+	}
+
+	if err := registeredDatabases.add(registration, handlerOpts.mergeDatabases); err != nil {
+		statsd.close()
+		return nil, errors.Wrapf(err, "could not register database %v", dbName)
 	}
+	handler.registerCallback(db)
+
+	dbInterface.applyPoolSettings()
+	dbInterface.checkPoolSettings(handlerOpts.logger)
+
+	r := &Registration{
+		db:           db,
+		info:         info,
+		opts:         handlerOpts,
+		handler:      handler,
+		dbMetrics:    dbMetrics,
+		pusher:       pusher,
+		statsd:       statsd,
+		expiry:       expiry,
+		registration: registration,
+	}
+
 	go dbMetrics.maintain()
+	if pusher != nil {
+		go pusher.maintain()
+	}
+	if statsd != nil {
+		go statsd.maintain()
+	}
+	if expiry != nil {
+		go expiry.maintain(r.expire)
+	}
 
-	return nil
+	return r, nil
 }
@@ -0,0 +1,858 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+type testUser struct {
+	ID   uint
+	Name string
+}
+
+// newTestDB opens an in-memory SQLite database containing the test_users table.
+func newTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection opens a new in-memory database.
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// registerTest registers gormetrics on db as database "test" against registry.
+func registerTest(t *testing.T, db *gorm.DB, registry *prometheus.Registry, opts ...RegisterOpt) *Registration {
+	t.Helper()
+
+	opts = append([]RegisterOpt{WithRegisterer(registry), WithLogger(testLogger{t})}, opts...)
+
+	r, err := NewRegistration(db, "test", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+
+	return r
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	l.t.Logf(format, v...)
+}
+
+// expectedCounter formats a counter of database "test" in the text exposition
+// format, with a series for every status (statuses missing in counts are 0).
+func expectedCounter(namespace, name, help string, kinds []string, counts map[string]int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(&b, "# TYPE %s_%s counter\n", namespace, name)
+	if len(kinds) == 0 {
+		for _, status := range []string{metricStatusFail, metricStatusSuccess} {
+			fmt.Fprintf(&b, "%s_%s{database=\"test\",driver=\"sqlite3\",status=%q} %d\n", namespace, name, status, counts[status])
+		}
+		return b.String()
+	}
+
+	// The counts only apply to the first kind, the other kinds are at 0.
+	for i, kind := range kinds {
+		for _, status := range []string{metricStatusFail, metricStatusSuccess} {
+			var count int
+			if i == 0 {
+				count = counts[status]
+			}
+			fmt.Fprintf(&b, "%s_%s{database=\"test\",driver=\"sqlite3\",kind=%q,status=%q} %d\n", namespace, name, kind, status, count)
+		}
+	}
+	return b.String()
+}
+
+func TestCallbacks(t *testing.T) {
+	tests := []struct {
+		name   string
+		run    func(db *gorm.DB)
+		metric string
+		help   string
+		kinds  []string
+		counts map[string]int
+
+		// vectors returns the vectors of the operation.
+		vectors func(c *queryCounters) (total, duration, executionDuration prometheus.Collector)
+	}{
+		{
+			name: "create",
+			run: func(db *gorm.DB) {
+				db.Create(&testUser{ID: 1, Name: "alice"})
+				db.Create(&testUser{ID: 1, Name: "bob"})
+			},
+			metric: metricCreatesTotal,
+			help:   helpCreatesTotal,
+			kinds:  operationKinds[OperationCreate],
+			vectors: func(c *queryCounters) (prometheus.Collector, prometheus.Collector, prometheus.Collector) {
+				return c.creates, c.createsDuration, c.createsExecutionDuration
+			},
+			counts: map[string]int{metricStatusSuccess: 1, metricStatusFail: 1},
+		},
+		{
+			name: "query",
+			run: func(db *gorm.DB) {
+				var users []testUser
+				db.Find(&users)
+				db.Table("missing").Find(&users)
+			},
+			metric: metricQueriesTotal,
+			help:   helpQueriesTotal,
+			vectors: func(c *queryCounters) (prometheus.Collector, prometheus.Collector, prometheus.Collector) {
+				return c.queries, c.queriesDuration, c.queriesExecutionDuration
+			},
+			counts: map[string]int{metricStatusSuccess: 1, metricStatusFail: 1},
+		},
+		{
+			name: "update",
+			run: func(db *gorm.DB) {
+				db.Model(&testUser{ID: 1}).Update("name", "bob")
+				db.Table("missing").Where("id = ?", 1).Update("name", "bob")
+			},
+			metric: metricUpdatesTotal,
+			help:   helpUpdatesTotal,
+			kinds:  operationKinds[OperationUpdate],
+			vectors: func(c *queryCounters) (prometheus.Collector, prometheus.Collector, prometheus.Collector) {
+				return c.updates, c.updatesDuration, c.updatesExecutionDuration
+			},
+			counts: map[string]int{metricStatusSuccess: 1, metricStatusFail: 1},
+		},
+		{
+			name: "delete",
+			run: func(db *gorm.DB) {
+				db.Delete(&testUser{ID: 1})
+				db.Table("missing").Where("id = ?", 1).Delete(&testUser{})
+			},
+			metric: metricDeletesTotal,
+			help:   helpDeletesTotal,
+			kinds:  operationKinds[OperationDelete],
+			vectors: func(c *queryCounters) (prometheus.Collector, prometheus.Collector, prometheus.Collector) {
+				return c.deletes, c.deletesDuration, c.deletesExecutionDuration
+			},
+			counts: map[string]int{metricStatusSuccess: 1, metricStatusFail: 1},
+		},
+		{
+			name: "suppressed",
+			run: func(db *gorm.DB) {
+				db.Set(DisableGormMetricsDatabaseKey, false).Create(&testUser{Name: "alice"})
+			},
+			metric: metricCreatesTotal,
+			help:   helpCreatesTotal,
+			kinds:  operationKinds[OperationCreate],
+			vectors: func(c *queryCounters) (prometheus.Collector, prometheus.Collector, prometheus.Collector) {
+				return c.creates, c.createsDuration, c.createsExecutionDuration
+			},
+			counts: map[string]int{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := registerTest(t, newTestDB(t), prometheus.NewRegistry())
+			tc.run(r.db)
+
+			total, duration, executionDuration := tc.vectors(r.handler.counters)
+
+			compare := []struct {
+				collector prometheus.Collector
+				metric    string
+				help      string
+				kinds     []string
+			}{
+				{total, tc.metric, tc.help, tc.kinds},
+				{r.handler.counters.all, metricAllTotal, helpAllTotal, nil},
+			}
+			for _, c := range compare {
+				want := expectedCounter("gormetrics", c.metric, c.help, c.kinds, tc.counts)
+				if err := testutil.CollectAndCompare(c.collector, strings.NewReader(want)); err != nil {
+					t.Fatalf("%s: %v", c.metric, err)
+				}
+			}
+
+			// Durations can't be compared, but every statement is observed.
+			statements := uint64(tc.counts[metricStatusSuccess] + tc.counts[metricStatusFail])
+			for _, histogram := range []prometheus.Collector{duration, executionDuration} {
+				if got := durationSummary(prometheus.Labels{labelDatabase: "test"}, histogram).Count; got != statements {
+					t.Fatalf("got %d observed durations, want %d", got, statements)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipleNamespaces(t *testing.T) {
+	db := newTestDB(t)
+	registry := prometheus.NewRegistry()
+
+	registrations := make(map[string]*Registration)
+	for _, namespace := range []string{"first", "second"} {
+		registrations[namespace] = registerTest(t, db, registry, WithPrometheusNamespace(namespace), WithGORMPluginScope(namespace))
+	}
+
+	db.Create(&testUser{Name: "alice"})
+
+	for namespace, r := range registrations {
+		want := expectedCounter(namespace, metricCreatesTotal, helpCreatesTotal, operationKinds[OperationCreate], map[string]int{metricStatusSuccess: 1})
+		if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+			t.Fatalf("%s: %v", namespace, err)
+		}
+	}
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	tests := map[string]struct {
+		first, second func(t *testing.T, db *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt)
+		name          string
+		err           error
+	}{
+		"same callbacks and scope": {
+			second: func(t *testing.T, db *gorm.DB, _ *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return db, []RegisterOpt{WithRegisterer(prometheus.NewRegistry())}
+			},
+			name: "test",
+			err:  ErrAlreadyRegistered,
+		},
+		"same callbacks and namespace": {
+			second: func(t *testing.T, db *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return db, []RegisterOpt{WithRegisterer(registry), WithGORMPluginScope("second")}
+			},
+			name: "test",
+			err:  ErrAlreadyRegistered,
+		},
+		"shared callbacks": {
+			second: func(t *testing.T, db *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return db.Session(&gorm.Session{}), []RegisterOpt{WithRegisterer(registry), WithPrometheusNamespace("second"), WithGORMPluginScope("second")}
+			},
+			name: "other",
+			err:  ErrSharedCallbacks,
+		},
+		"duplicate database": {
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry)}
+			},
+			name: "test",
+			err:  ErrDuplicateDatabase,
+		},
+		"merged database": {
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry), WithMergedDatabase()}
+			},
+			name: "test",
+		},
+		"other instance": {
+			first: func(t *testing.T, db *gorm.DB, _ *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return db, []RegisterOpt{WithInstance("first")}
+			},
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry), WithInstance("second")}
+			},
+			name: "test",
+		},
+		"instance next to a database without one": {
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry), WithInstance("second")}
+			},
+			name: "other",
+			err:  ErrInstanceMismatch,
+		},
+		"database without an instance next to one with one": {
+			first: func(t *testing.T, db *gorm.DB, _ *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return db, []RegisterOpt{WithInstance("first")}
+			},
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry)}
+			},
+			name: "other",
+			err:  ErrInstanceMismatch,
+		},
+		"instance on another namespace": {
+			second: func(t *testing.T, _ *gorm.DB, registry *prometheus.Registry) (*gorm.DB, []RegisterOpt) {
+				return newTestDB(t), []RegisterOpt{WithRegisterer(registry), WithPrometheusNamespace("second"), WithInstance("second")}
+			},
+			name: "other",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			registry := prometheus.NewRegistry()
+
+			var opts []RegisterOpt
+			if tc.first != nil {
+				db, opts = tc.first(t, db, registry)
+			}
+			registerTest(t, db, registry, opts...)
+
+			second, opts := tc.second(t, db, registry)
+			r, err := NewRegistration(second, tc.name, append(opts, WithLogger(testLogger{t}))...)
+			if err == nil {
+				_ = r.Close()
+			}
+
+			if got := errors.Cause(err); got != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestRegisterRetry(t *testing.T) {
+	db := newTestDB(t)
+	registry := prometheus.NewRegistry()
+
+	// A conflicting collector makes creating the database gauges fail.
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gormetrics",
+		Name:      metricIdleConnections,
+		Help:      "conflicting",
+	})
+	registry.MustRegister(conflicting)
+
+	if err := Register(db, "test", WithRegisterer(registry), WithLogger(testLogger{t})); err == nil {
+		t.Fatal("expected registering to fail")
+	}
+
+	// The failed registration left no callbacks behind.
+	db.Create(&testUser{Name: "alice"})
+
+	r := registerTest(t, db, prometheus.NewRegistry())
+	db.Create(&testUser{Name: "bob"})
+
+	want := expectedCounter("gormetrics", metricCreatesTotal, helpCreatesTotal, operationKinds[OperationCreate], map[string]int{metricStatusSuccess: 1})
+	if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstanceLabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	registrations := make(map[string]*Registration)
+	for _, instance := range []string{"first", "second"} {
+		registrations[instance] = registerTest(t, newTestDB(t), registry, WithInstance(instance))
+	}
+
+	registrations["first"].db.Create(&testUser{Name: "alice"})
+
+	want := `
+		# HELP gormetrics_creates_total ` + helpCreatesTotal + `
+		# TYPE gormetrics_creates_total counter
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="first",kind="plain",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="first",kind="plain",status="success"} 1
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="first",kind="upsert",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="first",kind="upsert",status="success"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="second",kind="plain",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="second",kind="plain",status="success"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="second",kind="upsert",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",instance="second",kind="upsert",status="success"} 0
+	`
+	if err := testutil.CollectAndCompare(registrations["first"].handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := registrations["second"].Snapshot(); got.Instance != "second" || got.All.Total() != 0 {
+		t.Fatalf("unexpected snapshot of second instance: %+v", got)
+	}
+}
+
+// expectedRegisteredDatabases formats the registered databases gauge in the
+// text exposition format.
+func expectedRegisteredDatabases(n int) string {
+	return fmt.Sprintf("# HELP gormetrics_%[1]s %[2]s\n# TYPE gormetrics_%[1]s gauge\ngormetrics_%[1]s %[3]d\n",
+		metricRegisteredDatabases, helpRegisteredDatabases, n)
+}
+
+func TestDeregister(t *testing.T) {
+	db := newTestDB(t)
+	registry := prometheus.NewRegistry()
+
+	r := registerTest(t, db, registry)
+	db.Create(&testUser{Name: "alice"})
+	r.dbMetrics.collect()
+
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expectedRegisteredDatabases(1)), "gormetrics_"+metricRegisteredDatabases); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&testUser{Name: "bob"})
+
+	for _, c := range append(r.handler.counters.collectors(), r.dbMetrics.gauges.collectors()...) {
+		if n := testutil.CollectAndCount(c); n != 0 {
+			t.Fatalf("expected no series after deregistering, got %d", n)
+		}
+	}
+
+	// The collectors of the last database are unregistered and forgotten.
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Fatalf("got %d series (%v), want none after deregistering the last database", n, err)
+	}
+	collectors.Lock()
+	for key := range collectors.query {
+		if key.registerer == registry {
+			t.Errorf("expected query counters of the registry to be released")
+		}
+	}
+	if len(collectors.all[registry]) != 0 {
+		t.Errorf("got %d collectors of the registry, want none", len(collectors.all[registry]))
+	}
+	collectors.Unlock()
+
+	r = registerTest(t, db, registry)
+	db.Create(&testUser{Name: "carol"})
+
+	want := expectedCounter("gormetrics", metricCreatesTotal, helpCreatesTotal, operationKinds[OperationCreate], map[string]int{metricStatusSuccess: 1})
+	if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTTL(t *testing.T) {
+	db := newTestDB(t)
+	registry := prometheus.NewRegistry()
+
+	r := registerTest(t, db, registry, WithIdleTTL(time.Hour))
+	db.Create(&testUser{Name: "alice"})
+
+	r.expire()
+	r.dbMetrics.collect()
+
+	for _, c := range append(r.handler.counters.collectors(), r.dbMetrics.gauges.connections()...) {
+		if n := testutil.CollectAndCount(c); n != 0 {
+			t.Fatalf("expected no series after expiring, got %d", n)
+		}
+	}
+
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expectedRegisteredDatabases(0)), "gormetrics_"+metricRegisteredDatabases); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Create(&testUser{Name: "bob"})
+	r.dbMetrics.collect()
+
+	want := expectedCounter("gormetrics", metricCreatesTotal, helpCreatesTotal, operationKinds[OperationCreate], map[string]int{metricStatusSuccess: 1})
+	if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(r.dbMetrics.gauges.open); n != 1 {
+		t.Fatalf("expected connection statistics to be collected again, got %d series", n)
+	}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expectedRegisteredDatabases(1)), "gormetrics_"+metricRegisteredDatabases); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTTLSmall(t *testing.T) {
+	e := newIdleExpiry(1)
+
+	expired := make(chan struct{}, 1)
+	go e.maintain(func() {
+		select {
+		case expired <- struct{}{}:
+		default:
+		}
+	})
+	defer e.stop()
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the database to expire")
+	}
+}
+
+func TestIdleTTLMergedDatabase(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	idle := registerTest(t, newTestDB(t), registry, WithIdleTTL(time.Hour), WithMergedDatabase())
+	active := registerTest(t, newTestDB(t), registry, WithIdleTTL(time.Hour), WithMergedDatabase())
+
+	idle.expire()
+	active.db.Create(&testUser{Name: "alice"})
+
+	want := expectedCounter("gormetrics", metricCreatesTotal, helpCreatesTotal, operationKinds[OperationCreate], map[string]int{metricStatusSuccess: 1})
+	if err := testutil.CollectAndCompare(active.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelLabel(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithModelLabel())
+
+	db.Create(&testUser{Name: "alice"})
+	db.Find(&[]testUser{})
+
+	want := `
+		# HELP gormetrics_all_total ` + helpAllTotal + `
+		# TYPE gormetrics_all_total counter
+		gormetrics_all_total{database="test",driver="sqlite3",model="testUser",status="fail"} 0
+		gormetrics_all_total{database="test",driver="sqlite3",model="testUser",status="success"} 2
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.all, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Statements whose model wasn't parsed fall back to the Go type.
+	stmt := db.Session(&gorm.Session{}).Statement
+	stmt.Model = &[]*testUser{}
+	if got := modelName(&gorm.DB{Statement: stmt}); got != "testUser" {
+		t.Fatalf("expected model testUser, got %v", got)
+	}
+}
+
+type testAuthor struct {
+	ID    uint
+	Name  string
+	Books []testBook `gorm:"foreignKey:AuthorID"`
+}
+
+type testBook struct {
+	ID          uint
+	AuthorID    uint
+	Title       string
+	Publisher   *testPublisher
+	PublisherID *uint
+}
+
+type testPublisher struct {
+	ID   uint
+	Name string
+}
+
+func TestAssociationStatements(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&testAuthor{}, &testBook{}, &testPublisher{}); err != nil {
+		t.Fatal(err)
+	}
+	r := registerTest(t, db, prometheus.NewRegistry())
+
+	db.Create(&testAuthor{
+		Name: "alice",
+		Books: []testBook{
+			{Title: "first", Publisher: &testPublisher{Name: "acme"}},
+			{Title: "second"},
+		},
+	})
+	db.Preload("Books").Find(&[]testAuthor{})
+	// Statements without associations aren't counted.
+	db.Find(&[]testAuthor{})
+
+	want := `
+		# HELP gormetrics_association_statements_total ` + helpAssociationStatementsTotal + `
+		# TYPE gormetrics_association_statements_total counter
+		gormetrics_association_statements_total{association="Books",database="test",driver="sqlite3",origin="preload",status="success"} 1
+		gormetrics_association_statements_total{association="Books",database="test",driver="sqlite3",origin="save_after_associations",status="success"} 1
+		gormetrics_association_statements_total{association="Publisher",database="test",driver="sqlite3",origin="save_before_associations",status="success"} 1
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.associationStatements, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Association statements are counted as regular statements as well. GORM
+	// saves associations with an ON CONFLICT clause, so they're upserts.
+	want = `
+		# HELP gormetrics_creates_total ` + helpCreatesTotal + `
+		# TYPE gormetrics_creates_total counter
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="plain",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="plain",status="success"} 1
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="upsert",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="upsert",status="success"} 2
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testEmployee struct {
+	ID        uint
+	Name      string
+	ManagerID *uint
+	Manager   *testEmployee
+	Reports   []testEmployee `gorm:"foreignKey:ManagerID"`
+	Skills    []testSkill    `gorm:"many2many:test_employee_skills"`
+}
+
+type testSkill struct {
+	ID   uint
+	Name string
+}
+
+func TestAssociationStatementsMatching(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(db *gorm.DB)
+		want string
+	}{
+		{
+			name: "many to many",
+			run: func(db *gorm.DB) {
+				db.Create(&testEmployee{Name: "alice", Skills: []testSkill{{Name: "go"}, {Name: "sql"}}})
+			},
+			// The skills and the rows of the join table.
+			want: `
+				gormetrics_association_statements_total{association="Skills",database="test",driver="sqlite3",origin="save_after_associations",status="success"} 2
+			`,
+		},
+		{
+			name: "self-referential",
+			run: func(db *gorm.DB) {
+				db.Create(&testEmployee{
+					Name:    "alice",
+					Manager: &testEmployee{Name: "bob"},
+					Reports: []testEmployee{{Name: "carol"}},
+				})
+				db.Preload(clause.Associations).Find(&[]testEmployee{})
+			},
+			want: `
+				gormetrics_association_statements_total{association="Manager",database="test",driver="sqlite3",origin="preload",status="success"} 1
+				gormetrics_association_statements_total{association="Manager",database="test",driver="sqlite3",origin="save_before_associations",status="success"} 1
+				gormetrics_association_statements_total{association="Reports",database="test",driver="sqlite3",origin="preload",status="success"} 1
+				gormetrics_association_statements_total{association="Reports",database="test",driver="sqlite3",origin="save_after_associations",status="success"} 1
+				gormetrics_association_statements_total{association="Skills",database="test",driver="sqlite3",origin="preload",status="success"} 1
+			`,
+		},
+		{
+			name: "nested preload",
+			run: func(db *gorm.DB) {
+				db.Create(&testPublisher{ID: 1, Name: "acme"})
+				db.Create(&testAuthor{ID: 1, Name: "alice"})
+				publisher := uint(1)
+				db.Omit(clause.Associations).Create(&testBook{AuthorID: 1, Title: "first", PublisherID: &publisher})
+				db.Preload("Books.Publisher").Find(&[]testAuthor{})
+			},
+			// The publishers are attributed to the books they're preloaded for.
+			want: `
+				gormetrics_association_statements_total{association="Books",database="test",driver="sqlite3",origin="preload",status="success"} 1
+				gormetrics_association_statements_total{association="Publisher",database="test",driver="sqlite3",origin="preload",status="success"} 1
+			`,
+		},
+		{
+			name: "joins",
+			run: func(db *gorm.DB) {
+				db.Omit(clause.Associations).Create(&testBook{Title: "first"})
+				db.Joins("Publisher").Find(&[]testBook{})
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.AutoMigrate(&testAuthor{}, &testBook{}, &testPublisher{}, &testEmployee{}, &testSkill{}); err != nil {
+				t.Fatal(err)
+			}
+			r := registerTest(t, db, prometheus.NewRegistry())
+
+			tc.run(db)
+
+			want := ""
+			if tc.want != "" {
+				want = `
+					# HELP gormetrics_association_statements_total ` + helpAssociationStatementsTotal + `
+					# TYPE gormetrics_association_statements_total counter
+				` + tc.want
+			}
+			if err := testutil.CollectAndCompare(r.handler.counters.associationStatements, strings.NewReader(want)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry())
+
+	// The last batch contains a single row, which is counted as well.
+	users := []testUser{{Name: "alice"}, {Name: "bob"}, {Name: "carol"}, {Name: "dave"}, {Name: "eve"}}
+	db.CreateInBatches(&users, 2)
+	db.Create(&testUser{Name: "frank"})
+
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&[]testUser{{Name: "grace"}, {Name: "heidi"}})
+	upserts := []testUser{{ID: 1, Name: "alice"}, {Name: "ivan"}, {Name: "judy"}}
+	db.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&upserts, 2)
+
+	want := `
+		# HELP gormetrics_batches_total ` + helpBatchesTotal + `
+		# TYPE gormetrics_batches_total counter
+		gormetrics_batches_total{database="test",driver="sqlite3",kind="plain"} 3
+		gormetrics_batches_total{database="test",driver="sqlite3",kind="upsert"} 3
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.batches, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	batchSizes := []struct {
+		kind       string
+		statements uint64
+		rows       float64
+	}{
+		{kindPlain, 4, 6},
+		{kindUpsert, 3, 5},
+	}
+
+	for _, b := range batchSizes {
+		h := collectDatabase(r.handler.counters.batchSize, prometheus.Labels{labelKind: b.kind})[0].GetHistogram()
+		if h.GetSampleCount() != b.statements || h.GetSampleSum() != b.rows {
+			t.Fatalf("%s: expected %d statements inserting %v rows, got %d inserting %v",
+				b.kind, b.statements, b.rows, h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+}
+
+type testNote struct {
+	ID        uint
+	Text      string
+	DeletedAt gorm.DeletedAt
+}
+
+func TestKindLabel(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&testNote{}); err != nil {
+		t.Fatal(err)
+	}
+	r := registerTest(t, db, prometheus.NewRegistry())
+
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&testNote{ID: 1, Text: "first"})
+	db.Delete(&testNote{ID: 1})
+	db.Unscoped().Delete(&testNote{ID: 1})
+	db.Delete(&testUser{ID: 1})
+
+	want := `
+		# HELP gormetrics_creates_total ` + helpCreatesTotal + `
+		# TYPE gormetrics_creates_total counter
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="plain",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="plain",status="success"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="upsert",status="fail"} 0
+		gormetrics_creates_total{database="test",driver="sqlite3",kind="upsert",status="success"} 1
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.creates, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Soft deletes are executed as updates, but counted as deletes.
+	want = `
+		# HELP gormetrics_deletes_total ` + helpDeletesTotal + `
+		# TYPE gormetrics_deletes_total counter
+		gormetrics_deletes_total{database="test",driver="sqlite3",kind="hard_delete",status="fail"} 0
+		gormetrics_deletes_total{database="test",driver="sqlite3",kind="hard_delete",status="success"} 2
+		gormetrics_deletes_total{database="test",driver="sqlite3",kind="soft_delete",status="fail"} 0
+		gormetrics_deletes_total{database="test",driver="sqlite3",kind="soft_delete",status="success"} 1
+	`
+	if err := testutil.CollectAndCompare(r.handler.counters.deletes, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolGauges(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithPoolSettings(PoolSettings{
+		MaxIdleConns:    1,
+		ConnMaxLifetime: time.Minute,
+	}))
+	r.dbMetrics.db.collectConnectionStats(r.dbMetrics.gauges, nil)
+
+	g := r.dbMetrics.gauges
+	gauges := []struct {
+		gauge  prometheus.Collector
+		metric string
+		help   string
+		value  float64
+	}{
+		{g.open, metricOpenConnections, helpOpenConnections, 1},
+		{g.idle, metricIdleConnections, helpIdleConnections, 1},
+		{g.inUse, metricInUseConnections, helpInUseConnections, 0},
+		{g.maxOpen, metricMaxOpenConnections, helpMaxOpenConnections, 1},
+		{g.maxIdle, metricMaxIdleConnections, helpMaxIdleConnections, 1},
+		{g.connMaxLifetime, metricConnectionMaxLifetime, helpConnectionMaxLifetime, 60},
+		{g.connMaxIdleTime, metricConnectionMaxIdleTime, helpConnectionMaxIdleTime, 0},
+	}
+
+	for _, gauge := range gauges {
+		want := fmt.Sprintf("# HELP gormetrics_%[1]s %[2]s\n# TYPE gormetrics_%[1]s gauge\n"+
+			"gormetrics_%[1]s{database=\"test\",driver=\"sqlite3\"} %[3]v\n", gauge.metric, gauge.help, gauge.value)
+		if err := testutil.CollectAndCompare(gauge.gauge, strings.NewReader(want)); err != nil {
+			t.Fatalf("%s: %v", gauge.metric, err)
+		}
+	}
+}
+
+func TestPoolSettingsApplied(t *testing.T) {
+	db := newTestDB(t)
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(2)
+
+	r := registerTest(t, db, prometheus.NewRegistry(), WithPoolSettings(PoolSettings{MaxIdleConns: 0}))
+
+	// Connections aren't kept idle after they're used.
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sqlDB.Stats(); stats.Idle != 0 || stats.MaxIdleClosed == 0 {
+		t.Fatalf("got %d idle connections and %d closed, want the idle connection to be closed", stats.Idle, stats.MaxIdleClosed)
+	}
+
+	r.dbMetrics.db.collectConnectionStats(r.dbMetrics.gauges, nil)
+	if got := testutil.ToFloat64(r.dbMetrics.gauges.maxIdle); got != 0 {
+		t.Fatalf("got max idle connections %v, want 0", got)
+	}
+
+	// database/sql limits the idle connections to the open connections.
+	r.dbMetrics.db.settings = &PoolSettings{MaxIdleConns: 5}
+	r.dbMetrics.db.collectConnectionStats(r.dbMetrics.gauges, nil)
+	if got := testutil.ToFloat64(r.dbMetrics.gauges.maxIdle); got != 2 {
+		t.Fatalf("got max idle connections %v, want 2", got)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PoolSettings describes the connection pool configuration of the *sql.DB
+// backing GORM. database/sql only exposes the maximum amount of open connections,
+// so the other settings are applied by WithPoolSettings to be exported and
+// checked.
+type PoolSettings struct {
+	// MaxIdleConns is passed to (*sql.DB).SetMaxIdleConns.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is passed to (*sql.DB).SetConnMaxLifetime.
+	ConnMaxLifetime time.Duration
+
+	// ConnMaxIdleTime is passed to (*sql.DB).SetConnMaxIdleTime.
+	ConnMaxIdleTime time.Duration
+
+	// BehindProxy indicates connections go through a proxy or load balancer
+	// (e.g. PgBouncer or a cloud SQL proxy), which usually closes connections
+	// on its own terms.
+	BehindProxy bool
+}
+
+// checkPoolSettings returns warnings for dangerous pool configurations, based
+// on the stats of the database and the declared settings (which may be nil).
+func checkPoolSettings(stats sql.DBStats, settings *PoolSettings) []string {
+	var warnings []string
+
+	if stats.MaxOpenConnections == 0 {
+		warnings = append(warnings, "the amount of open connections is unlimited, "+
+			"which can exhaust the connections of the database under load (see SetMaxOpenConns)")
+	}
+
+	if settings == nil {
+		return warnings
+	}
+
+	if stats.MaxOpenConnections > 0 && settings.MaxIdleConns > stats.MaxOpenConnections {
+		warnings = append(warnings, "the maximum amount of idle connections exceeds the maximum amount "+
+			"of open connections, database/sql reduces it to the maximum amount of open connections")
+	}
+
+	if settings.BehindProxy && settings.ConnMaxLifetime == 0 {
+		warnings = append(warnings, "connections never expire while going through a proxy, "+
+			"connections closed by the proxy will cause errors (see SetConnMaxLifetime)")
+	}
+
+	return warnings
+}
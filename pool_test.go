@@ -0,0 +1,62 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestCheckPoolSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		stats    sql.DBStats
+		settings *PoolSettings
+		want     int
+	}{
+		{
+			name:  "unlimited open connections",
+			stats: sql.DBStats{},
+			want:  1,
+		},
+		{
+			name:     "idle exceeds open",
+			stats:    sql.DBStats{MaxOpenConnections: 5},
+			settings: &PoolSettings{MaxIdleConns: 10},
+			want:     1,
+		},
+		{
+			name:     "zero lifetime behind proxy",
+			stats:    sql.DBStats{MaxOpenConnections: 5},
+			settings: &PoolSettings{MaxIdleConns: 5, BehindProxy: true},
+			want:     1,
+		},
+		{
+			name:     "sane settings",
+			stats:    sql.DBStats{MaxOpenConnections: 5},
+			settings: &PoolSettings{MaxIdleConns: 5, ConnMaxLifetime: time.Hour, BehindProxy: true},
+			want:     0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := checkPoolSettings(tc.stats, tc.settings); len(got) != tc.want {
+				t.Fatalf("got warnings %v, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -67,6 +67,23 @@ func (c gaugeVecCreator) new(
 type histogramVecCreator struct {
 	namespace string
 	labels    []string
+
+	// buckets are the buckets of the histograms, durationBuckets if nil.
+	buckets []float64
+}
+
+// durationBuckets are the buckets of the duration histograms, in milliseconds.
+var durationBuckets = []float64{
+	0.5,
+	1,
+	5,
+	10,
+	50,
+	500,
+	1000,
+	2000,
+	4000,
+	8000,
 }
 
 // new creates a new prometheus.GaugeVec based on the specified name and
@@ -75,24 +92,18 @@ func (c histogramVecCreator) new(
 	name string,
 	help string,
 ) *prometheus.HistogramVec {
+	buckets := c.buckets
+	if buckets == nil {
+		// TODO: Make configurable
+		buckets = durationBuckets
+	}
+
 	return prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: c.namespace,
 			Name:      name,
 			Help:      help,
-			// TODO: Make configurable
-			Buckets: []float64{
-				0.5,
-				1,
-				5,
-				10,
-				50,
-				500,
-				1000,
-				2000,
-				4000,
-				8000,
-			},
+			Buckets:   buckets,
 		},
 		c.labels,
 	)
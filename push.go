@@ -0,0 +1,156 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pusher periodically pushes the metrics of a single database to a Pushgateway,
+// for batch jobs and CLIs that exit before they are scraped.
+type pusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+	logger   Logger
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newPusher creates a pusher pushing cs for the database in info based on opts,
+// or returns nil if pushing is disabled. Only the series of the database are
+// pushed, the job, database and instance (if enabled) form the grouping key.
+func newPusher(info extraInfo, opts *pluginOpts, cs ...prometheus.Collector) (*pusher, error) {
+	if opts.pushgatewayURL == "" {
+		return nil, nil
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return nil, errors.Wrap(err, "could not register collectors")
+		}
+	}
+
+	grouping := prometheus.Labels{labelDatabase: info.dbName}
+	if info.instance != "" {
+		grouping[labelInstance] = info.instance
+	}
+
+	p := push.New(opts.pushgatewayURL, opts.pushgatewayJob).
+		Gatherer(databaseGatherer{gatherer: registry, grouping: grouping})
+	for name, value := range grouping {
+		p = p.Grouping(name, value)
+	}
+	if opts.pushgatewayClient != nil {
+		p = p.Client(opts.pushgatewayClient)
+	}
+
+	return &pusher{
+		pusher:   p,
+		interval: opts.pushgatewayInterval,
+		logger:   opts.logger,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// maintain pushes the metrics every interval until stop is called. Failed
+// pushes are logged, since the next push replaces them anyway.
+func (p *pusher) maintain() {
+	defer close(p.stopped)
+
+	if p.interval <= 0 {
+		<-p.done
+		return
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.pusher.Push(); err != nil {
+				p.logger.Printf("gormetrics: could not push metrics: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop stops pushing periodically and pushes the metrics a final time.
+func (p *pusher) stop() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		<-p.stopped
+
+		err = errors.Wrap(p.pusher.Push(), "could not push metrics")
+	})
+
+	return err
+}
+
+// databaseGatherer only gathers the series of a single database, without
+// the labels that are part of the grouping key of the Pushgateway.
+type databaseGatherer struct {
+	gatherer prometheus.Gatherer
+	grouping prometheus.Labels
+}
+
+func (g databaseGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	result := families[:0]
+	for _, family := range families {
+		metrics := family.Metric[:0]
+		for _, m := range family.Metric {
+			if matchLabels(m, g.grouping) {
+				m.Label = withoutLabels(m.Label, g.grouping)
+				metrics = append(metrics, m)
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			result = append(result, family)
+		}
+	}
+
+	return result, nil
+}
+
+// withoutLabels returns pairs without the labels in labels.
+func withoutLabels(pairs []*dto.LabelPair, labels prometheus.Labels) []*dto.LabelPair {
+	result := pairs[:0]
+	for _, l := range pairs {
+		if _, ok := labels[l.GetName()]; !ok {
+			result = append(result, l)
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPusher(t *testing.T) {
+	qc, err := newQueryCounters(prometheus.NewRegistry(), "push_test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, database := range []string{"a", "b"} {
+		qc.queries.With(prometheus.Labels{
+			labelStatus:   metricStatusSuccess,
+			labelDatabase: database,
+			labelDriver:   "sqlite3",
+		}).Inc()
+	}
+
+	var (
+		method, path string
+		families     []*dto.MetricFamily
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var family dto.MetricFamily
+			if err := decoder.Decode(&family); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Error(err)
+				break
+			}
+			families = append(families, &family)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	opts := defaultPluginOpts()
+	opts.pushgatewayURL = server.URL
+	opts.pushgatewayJob = "etl"
+
+	p, err := newPusher(extraInfo{dbName: "a", driverName: "sqlite3"}, opts, qc.queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.maintain()
+
+	if err := p.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPut || path != "/metrics/job/etl/database/a" {
+		t.Fatalf("got %v %v, want PUT /metrics/job/etl/database/a", method, path)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatalf("got %v, want a single series of database a", families)
+	}
+	for _, l := range families[0].Metric[0].Label {
+		if l.GetName() == labelDatabase {
+			t.Fatalf("got database label %v, want it in the grouping key only", l.GetValue())
+		}
+	}
+}
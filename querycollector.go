@@ -0,0 +1,260 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidQueryCollector is the error generated by gormetrics if a
+// QueryCollector is missing a name, query or value columns.
+const ErrInvalidQueryCollector gormetricsErr = "query collector needs a name, query and at least one value column"
+
+// QueryCollector describes gauges that are collected by executing SQL at scrape
+// time, similar to sql_exporter. Every row returned by the query results in
+// one sample per value column, labelled with the values of the label columns.
+type QueryCollector struct {
+	// Name of the metric, prefixed by the Prometheus namespace. If there are
+	// multiple value columns, the column name is appended to it.
+	Name string
+
+	// Help text of the metric.
+	Help string
+
+	// Query is the SQL that is executed, along with its arguments.
+	Query string
+	Args  []interface{}
+
+	// LabelColumns are the columns of which the values are used as labels.
+	LabelColumns []string
+
+	// ValueColumns are the columns containing the values of the gauges. Values
+	// must be numeric (or a string containing a number).
+	ValueColumns []string
+
+	// CacheFor is the duration the results of the query are reused for,
+	// so scrapes don't put a load on the database. 0 disables the cache.
+	CacheFor time.Duration
+
+	// Timeout of the query, 0 means no timeout.
+	Timeout time.Duration
+}
+
+// queryCollector is a prometheus.Collector executing a QueryCollector.
+type queryCollector struct {
+	config QueryCollector
+	db     *gorm.DB
+	logger Logger
+
+	// descs contains a description per value column.
+	descs []*prometheus.Desc
+
+	// cached contains the results of the last query, collected at collected.
+	// collected is zero if the query didn't succeed yet; cached may be empty.
+	cached    []prometheus.Metric
+	collected time.Time
+	sync.Mutex
+}
+
+// newQueryCollector creates a queryCollector for config, which executes
+// queries on db. info is used for the constant database, driver and instance labels.
+func newQueryCollector(config QueryCollector, db *gorm.DB, info extraInfo, opts *pluginOpts) (*queryCollector, error) {
+	if config.Name == "" || config.Query == "" || len(config.ValueColumns) == 0 {
+		return nil, ErrInvalidQueryCollector
+	}
+
+	constLabels := info.labels()
+
+	descs := make([]*prometheus.Desc, len(config.ValueColumns))
+	for i, column := range config.ValueColumns {
+		name := config.Name
+		if len(config.ValueColumns) > 1 {
+			name = fmt.Sprintf("%v_%v", config.Name, column)
+		}
+
+		descs[i] = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.prometheusNamespace, "", name),
+			config.Help,
+			config.LabelColumns,
+			constLabels,
+		)
+	}
+
+	return &queryCollector{
+		config: config,
+		db:     db,
+		logger: opts.logger,
+		descs:  descs,
+	}, nil
+}
+
+// Describe sends the descriptions of all value columns to ch.
+func (c *queryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect executes the query (or reuses the cached results) and sends the
+// resulting gauges to ch. Failing queries are logged, no gauges are sent in
+// that case so the rest of the scrape still succeeds.
+func (c *queryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.collected.IsZero() || time.Since(c.collected) >= c.config.CacheFor {
+		metrics, err := c.query()
+		if err != nil {
+			c.logger.Printf("gormetrics: query collector %v: %v", c.config.Name, err)
+			return
+		}
+
+		c.cached = metrics
+		c.collected = time.Now()
+	}
+
+	for _, m := range c.cached {
+		ch <- m
+	}
+}
+
+// query executes the query and converts the results to gauges. Rows runs the
+// row callbacks of GORM, which gormetrics doesn't instrument, so the query is
+// never included in the query metrics.
+func (c *queryCollector) query() ([]prometheus.Metric, error) {
+	ctx := context.Background()
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+
+	rows, err := c.db.
+		Session(&gorm.Session{NewDB: true}).
+		WithContext(ctx).
+		Raw(c.config.Query, c.config.Args...).
+		Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not execute query")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get columns")
+	}
+
+	var metrics []prometheus.Metric
+	for rows.Next() {
+		row, err := scanRow(rows, columns)
+		if err != nil {
+			return nil, err
+		}
+
+		labelValues := make([]string, len(c.config.LabelColumns))
+		for i, column := range c.config.LabelColumns {
+			value, ok := row[column]
+			if !ok {
+				return nil, errors.Errorf("label column %v not found", column)
+			}
+			labelValues[i] = labelValue(value)
+		}
+
+		for i, column := range c.config.ValueColumns {
+			value, ok := row[column]
+			if !ok {
+				return nil, errors.Errorf("value column %v not found", column)
+			}
+
+			f, err := gaugeValue(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value in column %v", column)
+			}
+
+			m, err := prometheus.NewConstMetric(c.descs[i], prometheus.GaugeValue, f, labelValues...)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, m)
+		}
+	}
+
+	return metrics, rows.Err()
+}
+
+// scanRow scans the current row of rows into a map by column name.
+func scanRow(rows *sql.Rows, columns []string) (map[string]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, errors.Wrap(err, "could not scan row")
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+	return row, nil
+}
+
+// labelValue converts a value scanned from a label column to a string.
+func labelValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// gaugeValue converts a value scanned from a value column to a float.
+func gaugeValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case time.Time:
+		return float64(v.Unix()), nil
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case nil:
+		return 0, nil
+	default:
+		return 0, errors.Errorf("unsupported type %T", value)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingLogger records the messages logged by gormetrics.
+type recordingLogger struct {
+	messages []string
+	sync.Mutex
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestQueryCollector(t *testing.T) {
+	db := newTestDB(t)
+	registry := prometheus.NewRegistry()
+	r := registerTest(t, db, registry)
+
+	db.Create(&[]testUser{{Name: "alice"}, {Name: "alice"}, {Name: "bob"}})
+
+	err := r.RegisterQueryCollector(QueryCollector{
+		Name:         "users",
+		Help:         "Users per name",
+		Query:        "SELECT name, COUNT(*) AS count, MAX(id) AS max_id FROM test_users WHERE id > ? GROUP BY name",
+		Args:         []interface{}{0},
+		LabelColumns: []string{"name"},
+		ValueColumns: []string{"count", "max_id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+		# HELP gormetrics_users_count Users per name
+		# TYPE gormetrics_users_count gauge
+		gormetrics_users_count{database="test",driver="sqlite3",name="alice"} 2
+		gormetrics_users_count{database="test",driver="sqlite3",name="bob"} 1
+		# HELP gormetrics_users_max_id Users per name
+		# TYPE gormetrics_users_max_id gauge
+		gormetrics_users_max_id{database="test",driver="sqlite3",name="alice"} 2
+		gormetrics_users_max_id{database="test",driver="sqlite3",name="bob"} 3
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "gormetrics_users_count", "gormetrics_users_max_id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queries of the collector aren't part of the query metrics.
+	if got := r.Snapshot().Operations[OperationQuery].Total(); got != 0 {
+		t.Fatalf("got %d queries, want 0", got)
+	}
+}
+
+func TestQueryCollectorCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheFor time.Duration
+		want     float64
+	}{
+		{name: "cached", cacheFor: time.Hour, want: 1},
+		{name: "not cached", want: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			r := registerTest(t, db, prometheus.NewRegistry())
+
+			c, err := newQueryCollector(QueryCollector{
+				Name:         "users",
+				Query:        "SELECT COUNT(*) AS count FROM test_users",
+				ValueColumns: []string{"count"},
+				CacheFor:     tc.cacheFor,
+			}, db, r.info, r.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db.Create(&testUser{Name: "alice"})
+			if got := testutil.ToFloat64(c); got != 1 {
+				t.Fatalf("got %v users, want 1", got)
+			}
+
+			db.Create(&testUser{Name: "bob"})
+			if got := testutil.ToFloat64(c); got != tc.want {
+				t.Fatalf("got %v users, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueryCollectorCacheEmptyResult(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry())
+
+	c, err := newQueryCollector(QueryCollector{
+		Name:         "users",
+		Query:        "SELECT name, COUNT(*) AS count FROM test_users GROUP BY name",
+		LabelColumns: []string{"name"},
+		ValueColumns: []string{"count"},
+		CacheFor:     time.Hour,
+	}, db, r.info, r.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Fatalf("got %d gauges, want none for an empty table", n)
+	}
+
+	// The empty result is cached as well.
+	db.Create(&testUser{Name: "alice"})
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Fatalf("got %d gauges, want the cached empty result", n)
+	}
+}
+
+func TestQueryCollectorTimeout(t *testing.T) {
+	db := newTestDB(t)
+	logger := &recordingLogger{}
+	r := registerTest(t, db, prometheus.NewRegistry(), WithLogger(logger))
+
+	c, err := newQueryCollector(QueryCollector{
+		Name: "slow",
+		Query: "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < 1000000000) " +
+			"SELECT COUNT(*) AS count FROM c",
+		ValueColumns: []string{"count"},
+		Timeout:      10 * time.Millisecond,
+	}, db, r.info, r.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Fatalf("got %d gauges, want none for a query that timed out", n)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "query collector slow") {
+		t.Fatalf("got log messages %q, want the failed query to be logged", logger.messages)
+	}
+}
+
+func TestInvalidQueryCollector(t *testing.T) {
+	r := registerTest(t, newTestDB(t), prometheus.NewRegistry())
+
+	if err := r.RegisterQueryCollector(QueryCollector{Name: "users", Query: "SELECT 1"}); err != ErrInvalidQueryCollector {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidQueryCollector)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// QueryStatsSummary contains the statements accounted by QueryStats.
+type QueryStatsSummary struct {
+	Creates int
+	Deletes int
+	Queries int
+	Updates int
+
+	// Failed is the amount of statements (of any operation) that failed.
+	Failed int
+
+	// Duration is the total time spent executing statements in the database driver.
+	Duration time.Duration
+
+	// Rows is the total amount of rows affected or returned by the statements.
+	Rows int64
+}
+
+// Total returns the amount of statements of all operations.
+func (s QueryStatsSummary) Total() int {
+	return s.Creates + s.Deletes + s.Queries + s.Updates
+}
+
+// String returns a short human-readable description of s.
+func (s QueryStatsSummary) String() string {
+	return fmt.Sprintf(
+		"%d queries (%d creates, %d deletes, %d selects, %d updates, %d failed) taking %v, %d rows",
+		s.Total(), s.Creates, s.Deletes, s.Queries, s.Updates, s.Failed, s.Duration, s.Rows,
+	)
+}
+
+// BudgetHandler is called when the statements accounted by QueryStats exceed
+// the configured budget, see WithQueryBudget. ctx is the context of the statement
+// that exceeded the budget.
+type BudgetHandler func(ctx context.Context, summary QueryStatsSummary)
+
+// LogBudgetExceeded creates a BudgetHandler which reports exceeded budgets to logger.
+func LogBudgetExceeded(logger Logger) BudgetHandler {
+	return func(_ context.Context, summary QueryStatsSummary) {
+		logger.Printf("gormetrics: query budget exceeded: %v", summary)
+	}
+}
+
+// FailBudgetExceeded creates a BudgetHandler which fails the test t when the
+// budget is exceeded. The test continues, so the statement exceeding the budget
+// (and its transaction) still finishes.
+func FailBudgetExceeded(t testing.TB) BudgetHandler {
+	return func(_ context.Context, summary QueryStatsSummary) {
+		t.Errorf("gormetrics: query budget exceeded: %v", summary)
+	}
+}
+
+// QueryStatsOpt configures a QueryStats instance created by WithQueryStats.
+type QueryStatsOpt func(s *QueryStats)
+
+// WithQueryBudget calls handler once the accounted statements exceed maxQueries
+// or take longer than maxDuration in total. A zero value disables that limit.
+// The handler is called at most once per QueryStats.
+func WithQueryBudget(maxQueries int, maxDuration time.Duration, handler BudgetHandler) QueryStatsOpt {
+	return func(s *QueryStats) {
+		s.maxQueries = maxQueries
+		s.maxDuration = maxDuration
+		s.budgetHandler = handler
+	}
+}
+
+// QueryStats accounts all statements executed with the context it is attached to.
+// It is safe for concurrent use.
+type QueryStats struct {
+	summary QueryStatsSummary
+
+	maxQueries    int
+	maxDuration   time.Duration
+	budgetHandler BudgetHandler
+	exceeded      bool
+
+	sync.Mutex
+}
+
+type queryStatsKey struct{}
+
+// WithQueryStats returns a copy of ctx with a QueryStats accumulator attached to it.
+// All statements executed with the returned context (e.g. using db.WithContext(ctx))
+// on a database registered with gormetrics are accounted, which makes it possible
+// to track the queries issued for a single HTTP request.
+func WithQueryStats(ctx context.Context, opts ...QueryStatsOpt) (context.Context, *QueryStats) {
+	stats := &QueryStats{}
+	for _, o := range opts {
+		o(stats)
+	}
+
+	return context.WithValue(ctx, queryStatsKey{}, stats), stats
+}
+
+// QueryStatsFromContext returns the QueryStats attached to ctx by WithQueryStats.
+func QueryStatsFromContext(ctx context.Context) (*QueryStats, bool) {
+	stats, ok := ctx.Value(queryStatsKey{}).(*QueryStats)
+	return stats, ok
+}
+
+// Summary returns the statements accounted so far.
+func (s *QueryStats) Summary() QueryStatsSummary {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.summary
+}
+
+// addStatement accounts a finished statement of the given operation.
+func (s *QueryStats) addStatement(ctx context.Context, operation Operation, rows int64, failed bool) {
+	s.Lock()
+
+	switch operation {
+	case OperationCreate:
+		s.summary.Creates++
+	case OperationDelete:
+		s.summary.Deletes++
+	case OperationQuery:
+		s.summary.Queries++
+	case OperationUpdate:
+		s.summary.Updates++
+	}
+
+	if failed {
+		s.summary.Failed++
+	}
+
+	s.summary.Rows += rows
+
+	exceeded, summary := s.exceedBudget()
+	s.Unlock()
+
+	if exceeded {
+		s.budgetHandler(ctx, summary)
+	}
+}
+
+// addDuration accounts time spent executing a statement in the database driver.
+func (s *QueryStats) addDuration(ctx context.Context, elapsed time.Duration) {
+	s.Lock()
+	s.summary.Duration += elapsed
+
+	exceeded, summary := s.exceedBudget()
+	s.Unlock()
+
+	if exceeded {
+		s.budgetHandler(ctx, summary)
+	}
+}
+
+// exceedBudget returns true (and the current summary) if the budget got exceeded
+// for the first time, in which case the budget handler should be called. The
+// handler may execute statements with the same context, so callers should call
+// it after unlocking s, which must be locked when calling exceedBudget.
+func (s *QueryStats) exceedBudget() (bool, QueryStatsSummary) {
+	if s.exceeded || s.budgetHandler == nil {
+		return false, s.summary
+	}
+
+	s.exceeded = (s.maxQueries > 0 && s.summary.Total() > s.maxQueries) ||
+		(s.maxDuration > 0 && s.summary.Duration > s.maxDuration)
+
+	return s.exceeded, s.summary
+}
+
+// queryStatsOf returns the QueryStats attached to the statement context of db.
+func queryStatsOf(db *gorm.DB) (*QueryStats, bool) {
+	if db.Statement.Context == nil {
+		return nil, false
+	}
+
+	return QueryStatsFromContext(db.Statement.Context)
+}
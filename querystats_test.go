@@ -0,0 +1,137 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestQueryStats(t *testing.T) {
+	db := newTestDB(t)
+	registerTest(t, db, prometheus.NewRegistry())
+
+	ctx, stats := WithQueryStats(context.Background())
+	withStats := db.WithContext(ctx)
+
+	withStats.Create(&testUser{Name: "alice"})
+	withStats.Create(&testUser{Name: "bob"})
+	withStats.Find(&[]testUser{})
+	withStats.Model(&testUser{}).Where("name = ?", "bob").Update("name", "carol")
+	withStats.Table("missing").Where("id = ?", 1).Delete(&testUser{})
+
+	// Statements executed without the context aren't accounted.
+	db.Find(&[]testUser{})
+
+	got := stats.Summary()
+	want := QueryStatsSummary{Creates: 2, Deletes: 1, Queries: 1, Updates: 1, Failed: 1, Rows: 5}
+	if got.Duration <= 0 {
+		t.Fatalf("got duration %v, want it to be positive", got.Duration)
+	}
+	got.Duration = 0
+	if got != want {
+		t.Fatalf("got summary %+v, want %+v", got, want)
+	}
+
+	if fromContext, ok := QueryStatsFromContext(ctx); !ok || fromContext != stats {
+		t.Fatal("expected QueryStatsFromContext to return the QueryStats")
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxQueries  int
+		maxDuration time.Duration
+		wantCalls   int
+	}{
+		{name: "queries", maxQueries: 2, wantCalls: 1},
+		{name: "duration", maxDuration: time.Nanosecond, wantCalls: 1},
+		{name: "not exceeded", maxQueries: 10},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			registerTest(t, db, prometheus.NewRegistry())
+
+			var summaries []QueryStatsSummary
+			ctx, _ := WithQueryStats(context.Background(), WithQueryBudget(tc.maxQueries, tc.maxDuration,
+				func(_ context.Context, summary QueryStatsSummary) {
+					summaries = append(summaries, summary)
+				}))
+
+			for i := 0; i < 5; i++ {
+				db.WithContext(ctx).Find(&[]testUser{})
+			}
+
+			if len(summaries) != tc.wantCalls {
+				t.Fatalf("got budget handler called %d times, want %d", len(summaries), tc.wantCalls)
+			}
+			for _, summary := range summaries {
+				exceeded := (tc.maxQueries > 0 && summary.Total() > tc.maxQueries) ||
+					(tc.maxDuration > 0 && summary.Duration > tc.maxDuration)
+				if !exceeded {
+					t.Fatalf("got budget handler called with %+v, which doesn't exceed the budget", summary)
+				}
+			}
+		})
+	}
+}
+
+func TestFailBudgetExceeded(t *testing.T) {
+	db := newTestDB(t)
+	registerTest(t, db, prometheus.NewRegistry())
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The statement exceeding the budget must release the only connection.
+	sqlDB.SetMaxOpenConns(1)
+
+	fake := &budgetT{TB: t}
+	ctx, _ := WithQueryStats(context.Background(), WithQueryBudget(1, 0, FailBudgetExceeded(fake)))
+	db.WithContext(ctx).Create(&testUser{Name: "alice"})
+	db.WithContext(ctx).Create(&testUser{Name: "bob"})
+
+	if len(fake.errors) != 1 || !strings.Contains(fake.errors[0], "query budget exceeded: 2 queries") {
+		t.Fatalf("got failures %q, want the budget to be exceeded", fake.errors)
+	}
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("got %d users, want the transaction exceeding the budget to be committed", len(users))
+	}
+}
+
+// budgetT records the failures reported by FailBudgetExceeded instead of
+// failing the test. Other methods are passed on to the embedded testing.TB.
+type budgetT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *budgetT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registration identifies a database gormetrics is registered on.
+type registration struct {
+	// callbacks is the callback processor of the database, see
+	// gorm.DB.Callback. It's shared by all sessions of a database and by
+	// databases opened with the same *gorm.Config.
+	callbacks interface{}
+	scope     string
+
+	registerer prometheus.Registerer
+	namespace  string
+
+	dbName   string
+	instance string
+
+	// expiry is nil if the idle TTL is disabled.
+	expiry *idleExpiry
+}
+
+// conflicts returns the error registering r would cause if other is already
+// registered, or nil if both can be registered.
+func (r *registration) conflicts(other *registration, merge bool) error {
+	sameCollectors := r.registerer == other.registerer && r.namespace == other.namespace
+	sameDatabase := r.dbName == other.dbName && r.instance == other.instance
+
+	switch {
+	case r.callbacks == other.callbacks && (r.scope == other.scope || sameCollectors):
+		return ErrAlreadyRegistered
+	case r.callbacks == other.callbacks && !sameDatabase:
+		return ErrSharedCallbacks
+	case r.callbacks != other.callbacks && sameCollectors && sameDatabase && !merge:
+		return ErrDuplicateDatabase
+	case sameCollectors && (r.instance == "") != (other.instance == ""):
+		return ErrInstanceMismatch
+	}
+
+	return nil
+}
+
+// sharesSeries returns true if r and other export the same series.
+func (r *registration) sharesSeries(other *registration) bool {
+	return r.registerer == other.registerer && r.namespace == other.namespace &&
+		r.dbName == other.dbName && r.instance == other.instance
+}
+
+type globalRegistrations struct {
+	all []*registration
+	sync.Mutex
+}
+
+// registeredDatabases contains every database gormetrics is registered on, to
+// detect registrations that would count statements twice or silently merge the
+// series of different databases.
+var registeredDatabases globalRegistrations
+
+// add adds r, unless it conflicts with an existing registration (see
+// registration.conflicts). If merge is true, r may share its series with a
+// different database.
+func (g *globalRegistrations) add(r *registration, merge bool) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if err := g.checkLocked(r, merge); err != nil {
+		return err
+	}
+
+	g.all = append(g.all, r)
+
+	return nil
+}
+
+// check returns the error adding r would cause, without adding it.
+func (g *globalRegistrations) check(r *registration, merge bool) error {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.checkLocked(r, merge)
+}
+
+// checkLocked is check, but must be called with g locked.
+func (g *globalRegistrations) checkLocked(r *registration, merge bool) error {
+	for _, other := range g.all {
+		if err := r.conflicts(other, merge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes r, e.g. if the database is deregistered. It returns true if
+// another database with the same series is still registered (see
+// WithMergedDatabase).
+func (g *globalRegistrations) remove(r *registration) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	merged := false
+	for i := len(g.all) - 1; i >= 0; i-- {
+		other := g.all[i]
+
+		switch {
+		case other == r:
+			g.all = append(g.all[:i], g.all[i+1:]...)
+		case other.sharesSeries(r):
+			merged = true
+		}
+	}
+
+	return merged
+}
+
+// merged returns true if another database with the same series as r is
+// registered (see WithMergedDatabase).
+func (g *globalRegistrations) merged(r *registration) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, other := range g.all {
+		if other != r && other.sharesSeries(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uses returns true if any database is registered with registerer and namespace.
+func (g *globalRegistrations) uses(registerer prometheus.Registerer, namespace string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, r := range g.all {
+		if r.registerer == registerer && r.namespace == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// active returns the amount of databases registered with registerer and
+// namespace that haven't expired (see WithIdleTTL).
+func (g *globalRegistrations) active(registerer prometheus.Registerer, namespace string) int {
+	g.Lock()
+	defer g.Unlock()
+
+	n := 0
+	for _, r := range g.all {
+		if r.registerer == registerer && r.namespace == namespace && !r.expiry.expired() {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"database/sql"
+	"expvar"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ErrExpvarPublished is the error returned by Registration.PublishExpvar if a
+// variable with the same name is already published.
+const ErrExpvarPublished gormetricsErr = "expvar variable is already published"
+
+// Snapshot contains the values of the metrics of a single database at a point
+// in time, see Registration.Snapshot.
+type Snapshot struct {
+	Database string `json:"database"`
+	Driver   string `json:"driver"`
+	Instance string `json:"instance,omitempty"`
+
+	// All contains the totals of all operations.
+	All        OperationSnapshot               `json:"all"`
+	Operations map[Operation]OperationSnapshot `json:"operations"`
+
+	NPlusOneDetected uint64 `json:"n_plus_one_detected"`
+
+	// Pool contains the statistics of the connection pool of the database.
+	Pool sql.DBStats `json:"pool"`
+}
+
+// OperationSnapshot contains the values of the metrics of a single operation.
+type OperationSnapshot struct {
+	Succeeded uint64 `json:"succeeded"`
+	Failed    uint64 `json:"failed"`
+
+	// Duration covers the complete GORM pipeline, ExecutionDuration the
+	// statement itself. See the *_duration and *_execution_duration metrics.
+	Duration          DurationSummary `json:"duration"`
+	ExecutionDuration DurationSummary `json:"execution_duration"`
+}
+
+// Total returns the amount of succeeded and failed statements.
+func (s OperationSnapshot) Total() uint64 {
+	return s.Succeeded + s.Failed
+}
+
+// DurationSummary summarizes the observations of a duration histogram.
+type DurationSummary struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+}
+
+// Mean returns the average duration, or 0 if nothing was observed.
+func (s DurationSummary) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// newSnapshot reads the values of the metrics of the database in info from the
+// collectors.
+func newSnapshot(info extraInfo, counters *queryCounters, db *database) Snapshot {
+	labels := info.labels()
+
+	s := Snapshot{
+		Database: info.dbName,
+		Driver:   info.driverName,
+		Instance: info.instance,
+		All: operationSnapshot(
+			labels, counters.all, counters.allDuration, counters.allExecutionDuration,
+		),
+		Operations: map[Operation]OperationSnapshot{
+			OperationCreate: operationSnapshot(
+				labels, counters.creates, counters.createsDuration, counters.createsExecutionDuration,
+			),
+			OperationDelete: operationSnapshot(
+				labels, counters.deletes, counters.deletesDuration, counters.deletesExecutionDuration,
+			),
+			OperationQuery: operationSnapshot(
+				labels, counters.queries, counters.queriesDuration, counters.queriesExecutionDuration,
+			),
+			OperationUpdate: operationSnapshot(
+				labels, counters.updates, counters.updatesDuration, counters.updatesExecutionDuration,
+			),
+		},
+		Pool: db.db.Stats(),
+	}
+
+	for _, m := range collectDatabase(counters.nPlusOneDetected, labels) {
+		s.NPlusOneDetected += uint64(m.GetCounter().GetValue())
+	}
+
+	return s
+}
+
+// operationSnapshot reads the values of a single operation from its collectors.
+func operationSnapshot(labels prometheus.Labels, total prometheus.Collector, duration, executionDuration prometheus.Collector) OperationSnapshot {
+	var s OperationSnapshot
+
+	for _, m := range collectDatabase(total, labels) {
+		if metricLabel(m, labelStatus) == metricStatusSuccess {
+			s.Succeeded += uint64(m.GetCounter().GetValue())
+		} else {
+			s.Failed += uint64(m.GetCounter().GetValue())
+		}
+	}
+
+	s.Duration = durationSummary(labels, duration)
+	s.ExecutionDuration = durationSummary(labels, executionDuration)
+
+	return s
+}
+
+// durationSummary sums the observations of all series of the database
+// identified by labels in a histogram (in milliseconds).
+func durationSummary(labels prometheus.Labels, histogram prometheus.Collector) DurationSummary {
+	var s DurationSummary
+
+	for _, m := range collectDatabase(histogram, labels) {
+		s.Count += m.GetHistogram().GetSampleCount()
+		s.Sum += time.Duration(m.GetHistogram().GetSampleSum() * float64(time.Millisecond))
+	}
+
+	return s
+}
+
+// collectDatabase returns the series of c of the database identified by labels.
+func collectDatabase(c prometheus.Collector, labels prometheus.Labels) []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var result []*dto.Metric
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+
+		if matchLabels(&m, labels) {
+			result = append(result, &m)
+		}
+	}
+
+	return result
+}
+
+// matchLabels returns true if m has all labels.
+func matchLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		if metricLabel(m, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// metricLabel returns the value of label name of m.
+func metricLabel(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// publishExpvar publishes snapshot under name in expvar.
+func publishExpvar(name string, snapshot func() Snapshot) error {
+	if expvar.Get(name) != nil {
+		return ErrExpvarPublished
+	}
+
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return snapshot()
+	}))
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSnapshot(t *testing.T) {
+	qc, err := newQueryCounters(prometheus.NewRegistry(), "snapshot_test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observe := func(database, status string, d time.Duration) {
+		labels := prometheus.Labels{labelDatabase: database, labelDriver: "sqlite3", labelStatus: status}
+		qc.queries.With(labels).Inc()
+		qc.queriesDuration.With(labels).Observe(milliseconds(d))
+		qc.all.With(labels).Inc()
+	}
+	observe("a", metricStatusSuccess, 10*time.Millisecond)
+	observe("a", metricStatusSuccess, 20*time.Millisecond)
+	observe("a", metricStatusFail, 30*time.Millisecond)
+	observe("b", metricStatusSuccess, time.Second)
+
+	s := newSnapshot(extraInfo{dbName: "a", driverName: "sqlite3"}, qc, &database{db: &sql.DB{}})
+
+	queries := s.Operations[OperationQuery]
+	if queries.Succeeded != 2 || queries.Failed != 1 || s.All.Total() != 3 {
+		t.Fatalf("got %+v (all %+v), want 2 succeeded and 1 failed", queries, s.All)
+	}
+	if queries.Duration.Count != 3 || queries.Duration.Mean() != 20*time.Millisecond {
+		t.Fatalf("got duration %+v, want 3 observations with a mean of 20ms", queries.Duration)
+	}
+	if creates := s.Operations[OperationCreate]; creates.Total() != 0 {
+		t.Fatalf("got creates %+v, want none", creates)
+	}
+}
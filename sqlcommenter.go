@@ -0,0 +1,244 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Keys of the values added to statements by the SQL commenter.
+const (
+	sqlCommentApplication = "application"
+	sqlCommentCaller      = "caller"
+	sqlCommentDatabase    = "database"
+	sqlCommentRoute       = "route"
+	sqlCommentTraceparent = "traceparent"
+)
+
+type routeKey struct{}
+
+// WithRoute returns a copy of ctx containing route (e.g. "/users/{id}"). The
+// SQL commenter adds it to all statements executed with the returned context.
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// routeOf returns the route stored in ctx by WithRoute.
+func routeOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	route, _ := ctx.Value(routeKey{}).(string)
+	return route
+}
+
+// SQLCommentOpt configures the SQL commenter enabled by WithSQLCommenter.
+type SQLCommentOpt func(c *sqlCommenter)
+
+// SQLCommentApplication adds application='name' to all statements.
+func SQLCommentApplication(name string) SQLCommentOpt {
+	return func(c *sqlCommenter) {
+		c.application = name
+	}
+}
+
+// SQLCommentTraceparent adds the W3C traceparent returned by traceparent to all
+// statements, e.g. using the span stored in the statement context by a tracing
+// library. Nothing is added if traceparent returns an empty string.
+func SQLCommentTraceparent(traceparent func(ctx context.Context) string) SQLCommentOpt {
+	return func(c *sqlCommenter) {
+		c.traceparent = traceparent
+	}
+}
+
+// SQLCommentWithoutCaller omits the location of the application code that
+// issued the statement, which saves walking the stack for every statement.
+func SQLCommentWithoutCaller() SQLCommentOpt {
+	return func(c *sqlCommenter) {
+		c.caller = false
+	}
+}
+
+// SQLCommentOperations only comments statements of the given operations.
+// By default, statements of all operations are commented.
+func SQLCommentOperations(operations ...Operation) SQLCommentOpt {
+	return func(c *sqlCommenter) {
+		c.operations = make(map[Operation]bool, len(operations))
+		for _, o := range operations {
+			c.operations[o] = true
+		}
+	}
+}
+
+// sqlCommenter appends sqlcommenter (https://google.github.io/sqlcommenter/)
+// formatted comments to statements before they are executed.
+type sqlCommenter struct {
+	application string
+	caller      bool
+	traceparent func(ctx context.Context) string
+
+	// operations contains the operations for which statements are commented,
+	// all operations are commented if nil.
+	operations map[Operation]bool
+}
+
+// defaultSQLCommenter creates a sqlCommenter with the default values.
+func defaultSQLCommenter() *sqlCommenter {
+	return &sqlCommenter{
+		caller: true,
+	}
+}
+
+// comment adds a clause to the statement in db that writes the comment at the
+// end of the SQL built by the core GORM callback of operation. clauseName should
+// be unique to the plugin scope.
+func (c *sqlCommenter) comment(db *gorm.DB, operation Operation, clauseName string, labels map[string]string) {
+	if c.operations != nil && !c.operations[operation] {
+		return
+	}
+
+	// Statements with SQL built before the callback chain are left untouched.
+	if db.Statement.SQL.Len() > 0 {
+		return
+	}
+
+	tags := map[string]string{
+		sqlCommentDatabase: labels[labelDatabase],
+	}
+
+	if c.application != "" {
+		tags[sqlCommentApplication] = c.application
+	}
+
+	// Prepared statements are cached by their SQL, so tags that differ per
+	// call would prepare (and cache) a new statement for every call.
+	if !prepared(db) {
+		c.addCallTags(db, tags)
+	}
+
+	db.Statement.AddClause(sqlComment{
+		name: clauseName,
+		text: formatSQLComment(tags),
+	})
+
+	db.Statement.BuildClauses = withClause(db.Statement.BuildClauses, clauseName)
+}
+
+// addCallTags adds the tags that differ per call site or request to tags: the
+// caller, the route and the traceparent.
+func (c *sqlCommenter) addCallTags(db *gorm.DB, tags map[string]string) {
+	if c.caller {
+		if caller := callerOf(); caller != "" {
+			tags[sqlCommentCaller] = caller
+		}
+	}
+
+	if route := routeOf(db.Statement.Context); route != "" {
+		tags[sqlCommentRoute] = route
+	}
+
+	if c.traceparent != nil && db.Statement.Context != nil {
+		if traceparent := c.traceparent(db.Statement.Context); traceparent != "" {
+			tags[sqlCommentTraceparent] = traceparent
+		}
+	}
+}
+
+// prepared returns true if the statements of db are prepared and cached by
+// their SQL, see gorm.Config.PrepareStmt.
+func prepared(db *gorm.DB) bool {
+	switch db.Statement.ConnPool.(type) {
+	case *gorm.PreparedStmtDB, *gorm.PreparedStmtTX:
+		return true
+	}
+
+	return false
+}
+
+// withClause returns clauses with name appended, unless it's already part of it
+// (e.g. if the statement is reused). clauses may be shared with the callback
+// processor, so it's copied instead of appended to.
+func withClause(clauses []string, name string) []string {
+	for _, c := range clauses {
+		if c == name {
+			return clauses
+		}
+	}
+
+	result := make([]string, len(clauses), len(clauses)+1)
+	copy(result, clauses)
+	return append(result, name)
+}
+
+// withoutClause returns a copy of clauses without name.
+func withoutClause(clauses []string, name string) []string {
+	result := make([]string, 0, len(clauses))
+	for _, c := range clauses {
+		if c != name {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// formatSQLComment serializes tags as described in the sqlcommenter spec: keys
+// and values are URL encoded, values are quoted and the pairs are sorted by key.
+// URL encoding escapes quotes in values as well.
+func formatSQLComment(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, sqlCommentEscape(k)+"='"+sqlCommentEscape(v)+"'")
+	}
+
+	sort.Strings(pairs)
+
+	return "/*" + strings.Join(pairs, ",") + "*/"
+}
+
+// sqlCommentEscape URL encodes s, with spaces encoded as %20.
+func sqlCommentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// sqlComment is a GORM clause that writes a comment as-is.
+type sqlComment struct {
+	name string
+	text string
+}
+
+// Name returns the name of the clause, which should be part of the statement's
+// BuildClauses for the comment to be written.
+func (c sqlComment) Name() string {
+	return c.name
+}
+
+// Build writes the comment.
+func (c sqlComment) Build(builder clause.Builder) {
+	builder.WriteString(c.text)
+}
+
+// MergeClause replaces any existing comment. The name of the clause is cleared
+// so GORM doesn't write it in front of the comment.
+func (c sqlComment) MergeClause(cl *clause.Clause) {
+	cl.Name = ""
+	cl.Expression = c
+}
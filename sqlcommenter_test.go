@@ -0,0 +1,171 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+func TestFormatSQLComment(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{
+			tags: map[string]string{"route": "/param*d", "application": "my app"},
+			want: "/*application='my%20app',route='%2Fparam%2Ad'*/",
+		},
+		{
+			tags: map[string]string{"caller": "it's", "database": "db"},
+			want: "/*caller='it%27s',database='db'*/",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := formatSQLComment(tc.tags); got != tc.want {
+			t.Fatalf("formatSQLComment(%v) = %q, want %q", tc.tags, got, tc.want)
+		}
+	}
+}
+
+type testSoftDeletedUser struct {
+	ID        uint
+	Name      string
+	DeletedAt gorm.DeletedAt
+}
+
+func TestSQLCommenter(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(db *gorm.DB) *gorm.DB
+	}{
+		{
+			name: "create",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Create(&testUser{Name: "alice"})
+			},
+		},
+		{
+			name: "query",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Where("name = ?", "alice").Find(&[]testUser{})
+			},
+		},
+		{
+			name: "update",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Model(&testUser{ID: 1}).Update("name", "bob")
+			},
+		},
+		{
+			name: "delete",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Delete(&testUser{ID: 1})
+			},
+		},
+		{
+			name: "soft delete",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Delete(&testSoftDeletedUser{ID: 1})
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			registerTest(t, db, prometheus.NewRegistry(), WithSQLCommenter(SQLCommentApplication("app"), SQLCommentWithoutCaller()))
+
+			ctx := WithRoute(context.Background(), "/users")
+			sql := tc.run(db.Session(&gorm.Session{DryRun: true}).WithContext(ctx)).Statement.SQL.String()
+
+			want := "/*application='app',database='test',route='%2Fusers'*/"
+			if !strings.HasSuffix(sql, want) || strings.Count(sql, "/*") != 1 {
+				t.Fatalf("got SQL %q, want it to end with %q", sql, want)
+			}
+		})
+	}
+}
+
+func TestSQLCommenterPreparedStatements(t *testing.T) {
+	db := newTestDB(t)
+	registerTest(t, db, prometheus.NewRegistry(), WithSQLCommenter(SQLCommentApplication("app"),
+		SQLCommentTraceparent(func(context.Context) string { return "00-trace-span-01" })))
+
+	prepared := db.Session(&gorm.Session{PrepareStmt: true, DryRun: true}).WithContext(WithRoute(context.Background(), "/users"))
+
+	// The create runs in a transaction, which prepares statements as well.
+	for _, tx := range []*gorm.DB{
+		prepared.Create(&testUser{Name: "alice"}),
+		prepared.Find(&[]testUser{}),
+	} {
+		if tx.Error != nil {
+			t.Fatal(tx.Error)
+		}
+
+		want := "/*application='app',database='test'*/"
+		if sql := tx.Statement.SQL.String(); !strings.HasSuffix(sql, want) {
+			t.Fatalf("got SQL %q, want it to end with %q", sql, want)
+		}
+	}
+}
+
+func TestSQLCommenterReusedStatement(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithSQLCommenter(SQLCommentWithoutCaller()))
+	clauseName := r.opts.settingKey(sqlCommentClauseKey)
+
+	tx := db.Session(&gorm.Session{DryRun: true}).Model(&testUser{})
+	tx.Statement.BuildClauses = []string{"SELECT", "FROM", "WHERE"}
+
+	for i := 0; i < 2; i++ {
+		tx.Statement.SQL.Reset()
+		tx.Find(&[]testUser{})
+
+		if sql := tx.Statement.SQL.String(); strings.Count(sql, "/*") != 1 {
+			t.Fatalf("got SQL %q, want a single comment", sql)
+		}
+	}
+
+	var n int
+	for _, c := range tx.Statement.BuildClauses {
+		if c == clauseName {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("got clauses %v, want %v once", tx.Statement.BuildClauses, clauseName)
+	}
+}
+
+func TestSQLCommenterDeregister(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithSQLCommenter())
+
+	if err := r.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range db.Callback().Update().Clauses {
+		if c == r.opts.settingKey(sqlCommentClauseKey) {
+			t.Fatalf("got clauses %v, want the comment clause to be removed", db.Callback().Update().Clauses)
+		}
+	}
+}
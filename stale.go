@@ -0,0 +1,155 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minIdleCheckInterval is the minimum interval at which databases are checked
+// for being idle, so very small TTLs don't keep the checks spinning.
+const minIdleCheckInterval = 100 * time.Millisecond
+
+// idleExpiry keeps track of the last time a statement was executed on a
+// database, so its series can be deleted once it has been idle for longer than
+// the idle TTL (see WithIdleTTL). A nil idleExpiry never expires.
+type idleExpiry struct {
+	ttl time.Duration
+
+	// lastActive is the time of the last statement in Unix nanoseconds.
+	lastActive int64
+	// isExpired is 1 if the series of the database have been deleted.
+	isExpired int32
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newIdleExpiry creates an idleExpiry with ttl, or returns nil if ttl isn't
+// positive.
+func newIdleExpiry(ttl time.Duration) *idleExpiry {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &idleExpiry{
+		ttl:        ttl,
+		lastActive: time.Now().UnixNano(),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// touch marks the database as active. It returns true if the database expired,
+// so its series must be resolved again.
+func (e *idleExpiry) touch() bool {
+	if e == nil {
+		return false
+	}
+
+	atomic.StoreInt64(&e.lastActive, time.Now().UnixNano())
+	return e.expired()
+}
+
+// expired returns true if the series of the database have been deleted.
+func (e *idleExpiry) expired() bool {
+	return e != nil && atomic.LoadInt32(&e.isExpired) == 1
+}
+
+func (e *idleExpiry) setExpired(expired bool) {
+	if e == nil {
+		return
+	}
+
+	var v int32
+	if expired {
+		v = 1
+	}
+	atomic.StoreInt32(&e.isExpired, v)
+}
+
+// idle returns true if the database hasn't expired yet, but has been idle for
+// longer than the TTL at now.
+func (e *idleExpiry) idle(now time.Time) bool {
+	return !e.expired() && now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastActive))) > e.ttl
+}
+
+// maintain calls expire once the database has been idle for longer than the
+// TTL, checking every half TTL (but at most every minIdleCheckInterval) until
+// stop is called.
+func (e *idleExpiry) maintain(expire func()) {
+	defer close(e.stopped)
+
+	interval := e.ttl / 2
+	if interval < minIdleCheckInterval {
+		interval = minIdleCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if e.idle(now) {
+				expire()
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// stop stops checking if the database is idle.
+func (e *idleExpiry) stop() {
+	if e == nil {
+		return
+	}
+
+	e.closeOnce.Do(func() {
+		close(e.done)
+		<-e.stopped
+	})
+}
+
+// deleteableVec is implemented by the vectors of client_golang.
+type deleteableVec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+// deleteSeries deletes every series of cs that has all labels. Other collectors
+// than vectors are skipped.
+func deleteSeries(labels prometheus.Labels, cs ...prometheus.Collector) {
+	for _, c := range cs {
+		vec, ok := c.(deleteableVec)
+		if !ok {
+			continue
+		}
+
+		for _, m := range collectDatabase(vec, labels) {
+			series := make(prometheus.Labels, len(m.Label))
+			for _, l := range m.Label {
+				series[l.GetName()] = l.GetValue()
+			}
+			vec.Delete(series)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// LoggedStatement is a statement recorded by the statement log, see
+// WithStatementLog.
+type LoggedStatement struct {
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"operation"`
+	Database  string    `json:"database"`
+	Table     string    `json:"table"`
+
+	// SQL is the statement with its literals and placeholders replaced by ?,
+	// values are never recorded. Fingerprint is the normalized SQL, see NPlusOne.
+	SQL         string `json:"sql"`
+	Fingerprint string `json:"fingerprint"`
+
+	// Duration covers the complete GORM pipeline, equal to the *_duration metrics.
+	Duration time.Duration `json:"duration"`
+	Rows     int64         `json:"rows"`
+
+	// Error describes the error of a failed statement without its message,
+	// which may contain values, see redactError.
+	Error string `json:"error,omitempty"`
+
+	// Caller is the location of the application code that issued the statement.
+	Caller string `json:"caller,omitempty"`
+}
+
+// SlowestStatements are the slowest statements recorded for a single fingerprint,
+// slowest first.
+type SlowestStatements struct {
+	Fingerprint string            `json:"fingerprint"`
+	Statements  []LoggedStatement `json:"statements"`
+}
+
+// statementLogFingerprints is the maximum amount of fingerprints the slowest
+// statements are kept for. If it's reached, the fingerprint with the fastest
+// slowest statement is evicted.
+const statementLogFingerprints = 100
+
+// statementLog holds the most recent statements in a ring buffer and the slowest
+// statements per fingerprint.
+type statementLog struct {
+	recent []LoggedStatement
+	next   int
+	full   bool
+
+	slowestSize int
+	slowest     map[string][]LoggedStatement
+
+	sync.Mutex
+}
+
+// newStatementLog creates a statementLog based on opts, or returns nil if the
+// statement log is disabled. Negative sizes are treated as 0.
+func newStatementLog(opts *pluginOpts) *statementLog {
+	if opts.statementLogRecent <= 0 && opts.statementLogSlowest <= 0 {
+		return nil
+	}
+
+	recent := opts.statementLogRecent
+	if recent < 0 {
+		recent = 0
+	}
+
+	return &statementLog{
+		recent:      make([]LoggedStatement, recent),
+		slowestSize: opts.statementLogSlowest,
+		slowest:     make(map[string][]LoggedStatement),
+	}
+}
+
+// record adds the statement in db to the log.
+func (l *statementLog) record(db *gorm.DB, operation Operation, database string, elapsed time.Duration) {
+	if db.Statement.SQL.Len() == 0 {
+		return
+	}
+
+	s := LoggedStatement{
+		Time:      time.Now().Add(-elapsed),
+		Operation: operation,
+		Database:  database,
+		Table:     db.Statement.Table,
+		SQL:       redact(db.Statement.SQL.String()),
+		Duration:  elapsed,
+		Rows:      db.RowsAffected,
+		Caller:    callerOf(),
+	}
+	s.Fingerprint = collapsePlaceholders(s.SQL)
+	if db.Error != nil {
+		s.Error = redactError(db.Error)
+	}
+
+	l.add(s)
+}
+
+// gormErrors are the errors of GORM itself, whose messages never contain values.
+var gormErrors = []error{
+	gorm.ErrRecordNotFound,
+	gorm.ErrInvalidTransaction,
+	gorm.ErrNotImplemented,
+	gorm.ErrMissingWhereClause,
+	gorm.ErrUnsupportedRelation,
+	gorm.ErrPrimaryKeyRequired,
+	gorm.ErrModelValueRequired,
+	gorm.ErrInvalidData,
+	gorm.ErrUnsupportedDriver,
+	gorm.ErrRegistered,
+	gorm.ErrInvalidField,
+	gorm.ErrEmptySlice,
+	gorm.ErrDryRunModeUnsupported,
+	gorm.ErrInvalidDB,
+	gorm.ErrInvalidValue,
+	gorm.ErrInvalidValueOfLength,
+}
+
+// redactError describes err without values. Messages of driver errors often
+// contain values (e.g. the duplicate key of a unique violation), so only the
+// type of the error and its SQLSTATE (if the driver exposes it) are returned.
+func redactError(err error) string {
+	for _, gormErr := range gormErrors {
+		if errors.Is(err, gormErr) {
+			return gormErr.Error()
+		}
+	}
+
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		return fmt.Sprintf("%T (SQLSTATE %v)", state, state.SQLState())
+	}
+
+	return fmt.Sprintf("%T", err)
+}
+
+func (l *statementLog) add(s LoggedStatement) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.recent) > 0 {
+		l.recent[l.next] = s
+		l.next = (l.next + 1) % len(l.recent)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	if l.slowestSize <= 0 {
+		return
+	}
+
+	slowest, exists := l.slowest[s.Fingerprint]
+	if !exists && len(l.slowest) >= statementLogFingerprints && !l.evictFastest(s.Duration) {
+		return
+	}
+
+	i := sort.Search(len(slowest), func(i int) bool {
+		return slowest[i].Duration < s.Duration
+	})
+	if i >= l.slowestSize {
+		return
+	}
+
+	slowest = append(slowest, LoggedStatement{})
+	copy(slowest[i+1:], slowest[i:])
+	slowest[i] = s
+	if len(slowest) > l.slowestSize {
+		slowest = slowest[:l.slowestSize]
+	}
+	l.slowest[s.Fingerprint] = slowest
+}
+
+// evictFastest removes the fingerprint whose slowest statement is the fastest,
+// if it's faster than d. It returns false if no fingerprint was removed.
+func (l *statementLog) evictFastest(d time.Duration) bool {
+	var (
+		fastest  string
+		duration time.Duration = -1
+	)
+	for fp, statements := range l.slowest {
+		if duration < 0 || statements[0].Duration < duration {
+			fastest, duration = fp, statements[0].Duration
+		}
+	}
+
+	if duration < 0 || duration >= d {
+		return false
+	}
+
+	delete(l.slowest, fastest)
+	return true
+}
+
+// statementLogPage is the content of the statement log page.
+type statementLogPage struct {
+	Recent  []LoggedStatement   `json:"recent"`
+	Slowest []SlowestStatements `json:"slowest"`
+}
+
+// page returns the recent statements (newest first) and the slowest statements
+// per fingerprint, ordered by their slowest statement.
+func (l *statementLog) page() statementLogPage {
+	l.Lock()
+	defer l.Unlock()
+
+	var p statementLogPage
+
+	n := l.next
+	if l.full {
+		n = len(l.recent)
+	}
+	for i := 1; i <= n; i++ {
+		p.Recent = append(p.Recent, l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+
+	for fp, statements := range l.slowest {
+		p.Slowest = append(p.Slowest, SlowestStatements{
+			Fingerprint: fp,
+			Statements:  append([]LoggedStatement(nil), statements...),
+		})
+	}
+	sort.Slice(p.Slowest, func(i, j int) bool {
+		return p.Slowest[i].Statements[0].Duration > p.Slowest[j].Statements[0].Duration
+	})
+
+	return p
+}
+
+// statementLogHandler serves the statement log as HTML, or as JSON if requested
+// using ?format=json or the Accept header.
+type statementLogHandler struct {
+	log *statementLog
+}
+
+func (h statementLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.log == nil {
+		http.Error(w, "statement log is disabled, see gormetrics.WithStatementLog", http.StatusNotFound)
+		return
+	}
+
+	page := h.log.page()
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = statementLogTemplate.Execute(w, page)
+}
+
+var statementLogTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>gormetrics statements</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+td.sql { font-family: monospace; white-space: pre-wrap; }
+tr.error { background: #fdd; }
+</style>
+</head>
+<body>
+{{define "statements"}}
+<table>
+<tr><th>Time</th><th>Database</th><th>Operation</th><th>Table</th><th>Duration</th><th>Rows</th><th>Caller</th><th>SQL</th><th>Error</th></tr>
+{{range .}}
+<tr{{if .Error}} class="error"{{end}}>
+<td>{{.Time.Format "15:04:05.000"}}</td>
+<td>{{.Database}}</td>
+<td>{{.Operation}}</td>
+<td>{{.Table}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Rows}}</td>
+<td>{{.Caller}}</td>
+<td class="sql">{{.SQL}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+<h1>Recent statements</h1>
+{{template "statements" .Recent}}
+<h1>Slowest statements</h1>
+{{range .Slowest}}
+<h2>{{.Fingerprint}}</h2>
+{{template "statements" .Statements}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,168 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+func TestStatementLog(t *testing.T) {
+	l := newStatementLog(&pluginOpts{statementLogRecent: 3, statementLogSlowest: 2})
+
+	for i, d := range []time.Duration{5, 1, 3, 4, 2} {
+		fp := "SELECT * FROM a"
+		if i%2 == 1 {
+			fp = "SELECT * FROM b"
+		}
+		l.add(LoggedStatement{Fingerprint: fp, Duration: d, Rows: int64(i)})
+	}
+
+	p := l.page()
+
+	var recent []int64
+	for _, s := range p.Recent {
+		recent = append(recent, s.Rows)
+	}
+	if len(recent) != 3 || recent[0] != 4 || recent[1] != 3 || recent[2] != 2 {
+		t.Fatalf("got recent statements %v, want [4 3 2]", recent)
+	}
+
+	if len(p.Slowest) != 2 || p.Slowest[0].Fingerprint != "SELECT * FROM a" {
+		t.Fatalf("got slowest %+v, want SELECT * FROM a first", p.Slowest)
+	}
+	for _, group := range p.Slowest {
+		if len(group.Statements) != 2 || group.Statements[0].Duration < group.Statements[1].Duration {
+			t.Fatalf("%s: got slowest statements %+v, want 2 ordered by duration", group.Fingerprint, group.Statements)
+		}
+	}
+	if got := p.Slowest[0].Statements; got[0].Duration != 5 || got[1].Duration != 3 {
+		t.Fatalf("got durations %v and %v, want 5 and 3", got[0].Duration, got[1].Duration)
+	}
+}
+
+func TestStatementLogFingerprintLimit(t *testing.T) {
+	l := newStatementLog(&pluginOpts{statementLogSlowest: 1})
+
+	for i := 0; i < statementLogFingerprints; i++ {
+		l.add(LoggedStatement{Fingerprint: fmt.Sprintf("SELECT %d", i), Duration: time.Duration(i + 10)})
+	}
+
+	// Faster than every kept fingerprint, so it's dropped.
+	l.add(LoggedStatement{Fingerprint: "SELECT fast", Duration: 1})
+	if _, exists := l.slowest["SELECT fast"]; exists {
+		t.Fatal("expected statement faster than every fingerprint to be dropped")
+	}
+
+	// Slower than the fastest fingerprint, which is evicted.
+	l.add(LoggedStatement{Fingerprint: "SELECT slow", Duration: time.Hour})
+	if _, exists := l.slowest["SELECT slow"]; !exists {
+		t.Fatal("expected slow statement to be kept")
+	}
+	if _, exists := l.slowest["SELECT 0"]; exists {
+		t.Fatal("expected fastest fingerprint to be evicted")
+	}
+	if len(l.slowest) != statementLogFingerprints {
+		t.Fatalf("got %d fingerprints, want %d", len(l.slowest), statementLogFingerprints)
+	}
+}
+
+func TestStatementLogRedactsValues(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithStatementLog(10, 1))
+
+	db.Model(&testUser{}).Where("name = 'secret' AND id IN (1, 2)").Update("name", "other")
+
+	p := r.handler.statementLog.page()
+	if len(p.Recent) != 1 {
+		t.Fatalf("got %d recent statements, want 1", len(p.Recent))
+	}
+	if got, want := p.Recent[0].SQL, "UPDATE `test_users` SET `name`=? WHERE name = ? AND id IN (?, ?)"; got != want {
+		t.Fatalf("got SQL %q, want %q", got, want)
+	}
+	if got, want := p.Recent[0].Fingerprint, "UPDATE `test_users` SET `name`=? WHERE name = ? AND id IN (?)"; got != want {
+		t.Fatalf("got fingerprint %q, want %q", got, want)
+	}
+}
+
+func TestStatementLogNegativeSize(t *testing.T) {
+	l := newStatementLog(&pluginOpts{statementLogRecent: -1, statementLogSlowest: 5})
+	l.add(LoggedStatement{Fingerprint: "SELECT 1", Duration: 1})
+
+	if p := l.page(); len(p.Recent) != 0 || len(p.Slowest) != 1 {
+		t.Fatalf("got %d recent and %d slowest statements, want 0 and 1", len(p.Recent), len(p.Slowest))
+	}
+}
+
+func TestStatementLogRedactsErrors(t *testing.T) {
+	db := newTestDB(t)
+	r := registerTest(t, db, prometheus.NewRegistry(), WithStatementLog(10, 0))
+
+	db.Create(&testUser{ID: 1, Name: "alice"})
+	if err := db.Create(&testUser{ID: 1, Name: "alice"}).Error; err == nil {
+		t.Fatal("expected creating a duplicate user to fail")
+	}
+
+	p := r.handler.statementLog.page()
+	if got, want := p.Recent[0].Error, "sqlite3.Error"; got != want {
+		t.Fatalf("got error %q, want %q", got, want)
+	}
+}
+
+// sqlStateError is a driver error exposing its SQLSTATE, like the errors of pq
+// and pgx.
+type sqlStateError struct {
+	state, message string
+}
+
+func (e *sqlStateError) Error() string    { return e.message }
+func (e *sqlStateError) SQLState() string { return e.state }
+
+func TestRedactError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "gorm error",
+			err:  errors.Wrap(gorm.ErrRecordNotFound, "could not find user"),
+			want: "record not found",
+		},
+		{
+			name: "sqlstate",
+			err:  errors.Wrap(&sqlStateError{state: "23505", message: "Key (email)=(x@y) already exists"}, "could not create user"),
+			want: "*gormetrics.sqlStateError (SQLSTATE 23505)",
+		},
+		{
+			name: "other error",
+			err:  errors.New("value 42 is invalid"),
+			want: "*errors.fundamental",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redactError(tc.err); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// operationMetrics contains the names of the metrics of every operation.
+var operationMetrics = map[Operation]struct {
+	total             string
+	duration          string
+	executionDuration string
+}{
+	OperationCreate: {metricCreatesTotal, metricCreatesDuration, metricCreatesExecutionDuration},
+	OperationDelete: {metricDeletesTotal, metricDeletesDuration, metricDeletesExecutionDuration},
+	OperationQuery:  {metricQueriesTotal, metricQueriesDuration, metricQueriesExecutionDuration},
+	OperationUpdate: {metricUpdatesTotal, metricUpdatesDuration, metricUpdatesExecutionDuration},
+}
+
+// StatsDOpt configures the StatsD backend enabled by WithStatsD.
+type StatsDOpt func(c *statsdConfig)
+
+type statsdConfig struct {
+	addr string
+
+	// plain is true if labels are appended to the metric name instead of
+	// being sent as DogStatsD tags.
+	plain bool
+
+	sampleRate    float64
+	flushInterval time.Duration
+	maxPacketSize int
+}
+
+// StatsDPlainNames appends the values of labels to the metric names (e.g.
+// gormetrics.queries_total.my_database.pq.success) for StatsD servers that
+// don't support DogStatsD tags. Values are ordered by the name of their label.
+func StatsDPlainNames() StatsDOpt {
+	return func(c *statsdConfig) {
+		c.plain = true
+	}
+}
+
+// StatsDSampleRate only sends a fraction (0 < rate <= 1) of the counter
+// increments and timings, which the server scales back up. Gauges are always
+// sent. The default sample rate is 1.
+func StatsDSampleRate(rate float64) StatsDOpt {
+	return func(c *statsdConfig) {
+		c.sampleRate = rate
+	}
+}
+
+// StatsDFlushInterval sets the maximum time metrics are buffered before they're
+// sent, which must be positive. The default interval is 1 second.
+func StatsDFlushInterval(d time.Duration) StatsDOpt {
+	return func(c *statsdConfig) {
+		c.flushInterval = d
+	}
+}
+
+// StatsDMaxPacketSize sets the maximum size of a UDP packet containing multiple
+// metrics, which must be positive. The default size of 1432 bytes fits in the
+// MTU of most networks.
+func StatsDMaxPacketSize(n int) StatsDOpt {
+	return func(c *statsdConfig) {
+		c.maxPacketSize = n
+	}
+}
+
+// defaultStatsDConfig creates a new statsdConfig instance sending to addr with
+// the default values.
+func defaultStatsDConfig(addr string) *statsdConfig {
+	return &statsdConfig{
+		addr:          addr,
+		sampleRate:    1,
+		flushInterval: time.Second,
+		maxPacketSize: 1432,
+	}
+}
+
+// validate returns an error if c contains values the client can't work with.
+func (c *statsdConfig) validate() error {
+	switch {
+	case c.sampleRate <= 0 || c.sampleRate > 1:
+		return errors.Errorf("StatsD sample rate %v is not in (0, 1]", c.sampleRate)
+	case c.flushInterval <= 0:
+		return errors.Errorf("StatsD flush interval %v is not positive", c.flushInterval)
+	case c.maxPacketSize <= 0:
+		return errors.Errorf("StatsD max packet size %v is not positive", c.maxPacketSize)
+	}
+
+	return nil
+}
+
+// statsdClient sends metrics to a StatsD server over UDP, batching multiple
+// metrics in a single packet. All methods are no-ops on a nil client, which is
+// used when the StatsD backend is disabled.
+type statsdClient struct {
+	config    *statsdConfig
+	namespace string
+	conn      net.Conn
+
+	// random returns a number in [0, 1) to decide if a sampled metric is sent.
+	random func() float64
+
+	buf    []byte
+	closed bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sync.Mutex
+}
+
+// newStatsDClient creates a statsdClient based on opts, or returns nil if the
+// StatsD backend is disabled.
+func newStatsDClient(opts *pluginOpts) (*statsdClient, error) {
+	if opts.statsd == nil {
+		return nil, nil
+	}
+
+	if err := opts.statsd.validate(); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", opts.statsd.addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to StatsD server %v", opts.statsd.addr)
+	}
+
+	return &statsdClient{
+		config:    opts.statsd,
+		namespace: opts.prometheusNamespace,
+		conn:      conn,
+		random:    rand.Float64,
+		buf:       make([]byte, 0, opts.statsd.maxPacketSize),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// count increments the counter name by value.
+func (c *statsdClient) count(name string, value float64, labels prometheus.Labels) {
+	if c == nil || !c.sample() {
+		return
+	}
+
+	c.send(name, value, "c", labels, true)
+}
+
+// timing adds an observation of milliseconds to the timer name.
+func (c *statsdClient) timing(name string, milliseconds float64, labels prometheus.Labels) {
+	if c == nil || !c.sample() {
+		return
+	}
+
+	c.send(name, milliseconds, "ms", labels, true)
+}
+
+// gauge sets the gauge name to value.
+func (c *statsdClient) gauge(name string, value float64, labels prometheus.Labels) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, value, "g", labels, false)
+}
+
+// sample returns true if a sampled metric should be sent.
+func (c *statsdClient) sample() bool {
+	return c.config.sampleRate >= 1 || c.random() < c.config.sampleRate
+}
+
+// send formats a metric and adds it to the buffer, sending the buffer first if
+// the metric doesn't fit.
+func (c *statsdClient) send(name string, value float64, metricType string, labels prometheus.Labels, sampled bool) {
+	line := c.format(name, value, metricType, labels, sampled)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > c.config.maxPacketSize {
+		c.flushLocked()
+	}
+
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// format formats a metric in the StatsD line protocol, using DogStatsD tags
+// for labels unless plain names are configured.
+func (c *statsdClient) format(name string, value float64, metricType string, labels prometheus.Labels, sampled bool) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	if c.namespace != "" {
+		b.WriteString(c.namespace)
+		b.WriteByte('.')
+	}
+	b.WriteString(name)
+
+	if c.config.plain {
+		for _, k := range keys {
+			b.WriteByte('.')
+			b.WriteString(statsdSanitize(labels[k]))
+		}
+	}
+
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(metricType)
+
+	if sampled && c.config.sampleRate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(c.config.sampleRate, 'f', -1, 64))
+	}
+
+	if !c.config.plain && len(keys) > 0 {
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k)
+			b.WriteByte(':')
+			b.WriteString(statsdSanitize(labels[k]))
+		}
+	}
+
+	return b.String()
+}
+
+// statsdSanitize replaces characters with a special meaning in the StatsD line
+// protocol (or in metric names) in a label value.
+var statsdSanitize = strings.NewReplacer(
+	".", "_",
+	":", "_",
+	"|", "_",
+	"@", "_",
+	",", "_",
+	"#", "_",
+	" ", "_",
+	"\n", "_",
+).Replace
+
+// flushLocked sends the buffer. Errors are ignored, since StatsD metrics are
+// sent on a best-effort basis. Must be called with c locked.
+func (c *statsdClient) flushLocked() {
+	if len(c.buf) == 0 {
+		return
+	}
+
+	_, _ = c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+// maintain sends the buffer every flush interval until close is called.
+func (c *statsdClient) maintain() {
+	ticker := time.NewTicker(c.config.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Lock()
+			c.flushLocked()
+			c.Unlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close sends the remaining metrics and closes the connection. Metrics sent
+// after close are dropped.
+func (c *statsdClient) close() error {
+	if c == nil {
+		return nil
+	}
+
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.Lock()
+		defer c.Unlock()
+
+		c.flushLocked()
+		c.closed = true
+		err = c.conn.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Profects Group B.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormetrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsDClient(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []StatsDOpt
+		want []string
+	}{
+		{
+			name: "dogstatsd",
+			want: []string{
+				"gormetrics.queries_total:1|c|#database:my_db,driver:pq,status:success",
+				"gormetrics.queries_duration:1.5|ms|#database:my_db,driver:pq,status:success",
+				"gormetrics.connections_open:3|g|#database:my_db,driver:pq",
+			},
+		},
+		{
+			name: "plain names",
+			opts: []StatsDOpt{StatsDPlainNames()},
+			want: []string{
+				"gormetrics.queries_total.my_db.pq.success:1|c",
+				"gormetrics.queries_duration.my_db.pq.success:1.5|ms",
+				"gormetrics.connections_open.my_db.pq:3|g",
+			},
+		},
+		{
+			name: "batched with sample rate",
+			opts: []StatsDOpt{StatsDSampleRate(0.5), StatsDMaxPacketSize(1000)},
+			want: []string{
+				"gormetrics.queries_total:1|c|@0.5|#database:my_db,driver:pq,status:success\n" +
+					"gormetrics.queries_duration:1.5|ms|@0.5|#database:my_db,driver:pq,status:success\n" +
+					"gormetrics.connections_open:3|g|#database:my_db,driver:pq",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := defaultPluginOpts()
+			WithStatsD(listener.LocalAddr().String(), append([]StatsDOpt{StatsDMaxPacketSize(1)}, tc.opts...)...)(opts)
+
+			client, err := newStatsDClient(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.random = func() float64 { return 0.25 }
+
+			statementLabels := prometheus.Labels{labelDatabase: "my_db", labelDriver: "pq", labelStatus: metricStatusSuccess}
+			client.count(metricQueriesTotal, 1, statementLabels)
+			client.timing(metricQueriesDuration, 1.5, statementLabels)
+			client.gauge(metricOpenConnections, 3, prometheus.Labels{labelDatabase: "my_db", labelDriver: "pq"})
+			if err := client.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			buf := make([]byte, 2048)
+			for range tc.want {
+				_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := listener.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(buf[:n]))
+			}
+			_ = listener.Close()
+
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Fatalf("got packets %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatsDClientInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  StatsDOpt
+	}{
+		{name: "zero sample rate", opt: StatsDSampleRate(0)},
+		{name: "sample rate above 1", opt: StatsDSampleRate(1.5)},
+		{name: "zero flush interval", opt: StatsDFlushInterval(0)},
+		{name: "negative flush interval", opt: StatsDFlushInterval(-time.Second)},
+		{name: "zero max packet size", opt: StatsDMaxPacketSize(0)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultPluginOpts()
+			WithStatsD("127.0.0.1:8125", tc.opt)(opts)
+
+			if client, err := newStatsDClient(opts); err == nil {
+				_ = client.close()
+				t.Fatal("expected an error for the invalid configuration")
+			}
+		})
+	}
+}